@@ -4,8 +4,13 @@ import (
 	"context"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/go-multierror"
 
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
@@ -14,14 +19,35 @@ import (
 type vsphereSecretBackend struct {
 	*framework.Backend
 
-	getProvider func(context.Context, *clientSettings) (VSphereProvider, error)
-	client      *client
-	settings    *clientSettings
+	getProvider func(context.Context, *clientSettings, hclog.Logger) (VSphereProvider, error)
+
+	// connections caches the settings and client of each vCenter connection by name.
+	// The default connection, configured at "config", has an empty name.
+	connections map[string]*vsphereConnection
 	lock        sync.RWMutex
 
 	// Creating/deleting passwords against a single Application is a PATCH
 	// operation that must be locked per Application Object ID.
 	appLocks []*locksutil.LockEntry
+
+	// roleLocks serialize the deletion of a role with the issuance of its leases.
+	roleLocks []*locksutil.LockEntry
+
+	// solutionUserLock serializes the registration and rotation of the solution user.
+	solutionUserLock sync.Mutex
+
+	// roleKeyLock serializes the encryption of the role passwords with the changes of the role keyring.
+	roleKeyLock sync.Mutex
+	// roleKeyRotationLock serializes the rotations of the role key. It is taken before the roleLocks,
+	// which are taken before the roleKeyLock.
+	roleKeyRotationLock sync.Mutex
+
+	// mountIDLock serializes the generation of the mount identifier.
+	mountIDLock sync.Mutex
+
+	// tidyRunning is set while a tidy runs, lastTidy is the time of the last periodic tidy.
+	tidyRunning uint32
+	lastTidy    time.Time
 }
 
 // Factory configures and returns VSphere backends
@@ -34,28 +60,51 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 }
 
 func backend() *vsphereSecretBackend {
-	var b = vsphereSecretBackend{}
+	var b = vsphereSecretBackend{
+		connections: make(map[string]*vsphereConnection),
+		appLocks:    locksutil.CreateLocks(),
+		roleLocks:   locksutil.CreateLocks(),
+	}
 
 	b.Backend = &framework.Backend{
 		Help: strings.TrimSpace(backendHelp),
 		PathsSpecial: &logical.Paths{
 			SealWrapStorage: []string{
 				"config",
+				connectionsStoragePath + "*",
+				rolesStoragePath + "/*",
+				roleKeyStoragePath,
+				sessionsStoragePath + "*",
 			},
 		},
 		Paths: framework.PathAppend(
 			pathsRole(&b),
+			pathSolutionUser(&b),
+			pathsConnection(&b),
+			pathsVSphereRole(&b),
 			[]*framework.Path{
 				pathConfig(&b),
-				// pathServicePrincipal(&b),
+				pathEndpoints(&b),
+				pathPrivileges(&b),
+				pathInventory(&b),
+				pathRolePreview(&b),
+				pathServicePrincipal(&b),
+				pathTidy(&b),
+				pathRoleKey(&b),
+				pathRolesMigrate(&b),
 			},
 		),
 		Secrets: []*framework.Secret{
-			// secretServicePrincipal(&b),
-			// secretStaticServicePrincipal(&b),
+			secretServicePrincipal(&b),
+			secretStaticServicePrincipal(&b),
 		},
-		BackendType: logical.TypeLogical,
-		Invalidate:  b.invalidate,
+		BackendType:       logical.TypeLogical,
+		Invalidate:        b.invalidate,
+		Clean:             b.clean,
+		InitializeFunc:    b.initialize,
+		PeriodicFunc:      b.periodicFunc,
+		WALRollback:       b.walRollback,
+		WALRollbackMinAge: walRollbackMinAge,
 	}
 
 	b.getProvider = newVSphereProvider
@@ -63,21 +112,83 @@ func backend() *vsphereSecretBackend {
 	return &b
 }
 
-// reset clears the backend's cached client
+// reset clears the backend's cached client of the default connection
 // This is used when the configuration changes and a new client should be
 // created with the updated settings.
 func (b *vsphereSecretBackend) reset() {
+	b.resetConnection(defaultConnectionName)
+}
+
+// resetConnection clears the cached settings and client of a named connection.
+// The session of the client is logged out.
+func (b *vsphereSecretBackend) resetConnection(name string) {
 	b.lock.Lock()
-	defer b.lock.Unlock()
+	conn, ok := b.connections[name]
+	delete(b.connections, name)
+	b.lock.Unlock()
 
-	b.settings = nil
+	if ok {
+		b.closeConnection(context.Background(), conn)
+	}
+}
+
+// closeConnection logs out the session of the cached client of a connection removed from the cache.
+// The entry is marked closed, so that a client requested concurrently is not cached in it.
+func (b *vsphereSecretBackend) closeConnection(ctx context.Context, conn *vsphereConnection) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	conn.closed = true
+	if conn.client != nil {
+		b.closeClient(ctx, conn.client)
+		conn.client = nil
+	}
+}
+
+// clean logs out the sessions of all the connections when the backend is unmounted or reloaded.
+func (b *vsphereSecretBackend) clean(ctx context.Context) {
+	b.lock.Lock()
+	connections := b.connections
+	b.connections = make(map[string]*vsphereConnection)
+	b.lock.Unlock()
+
+	for _, conn := range connections {
+		b.closeConnection(ctx, conn)
+	}
 }
 
 func (b *vsphereSecretBackend) invalidate(ctx context.Context, key string) {
-	switch key {
-	case "config":
+	switch {
+	case key == configStoragePath:
 		b.reset()
+	case strings.HasPrefix(key, connectionsStoragePath):
+		b.resetConnection(strings.TrimPrefix(key, connectionsStoragePath))
+	}
+}
+
+// periodicFunc runs the maintenance tasks of the mount:
+//   - rotates the certificate of the solution user when it is about to expire,
+//   - deletes the orphaned dynamic users and permissions,
+//   - rotates the key of the role passwords.
+func (b *vsphereSecretBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	// The storage of the performance secondaries and standbys is written by the primary, which
+	// also owns the solution user and the dynamic users of the mount.
+	replicationState := b.System().ReplicationState()
+	if replicationState.HasState(consts.ReplicationPerformanceSecondary | consts.ReplicationPerformanceStandby) {
+		return nil
+	}
+
+	var merr *multierror.Error
+	if err := b.rotateSolutionUserIfNeeded(ctx, req.Storage); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+	if err := b.periodicTidy(ctx, req.Storage); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+	if err := b.rotateRoleKeyIfNeeded(ctx, req.Storage); err != nil {
+		merr = multierror.Append(merr, err)
 	}
+	return merr.ErrorOrNil()
 }
 
 const backendHelp = `
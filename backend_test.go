@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/helper/logging"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
@@ -35,12 +36,7 @@ func getTestBackend(t *testing.T, initConfig bool) (*vsphereSecretBackend, logic
 		t.Fatalf("unable to create backend: %v", err)
 	}
 
-	b.settings = &clientSettings{
-		URL:      govmomitest.SimulatorURL,
-		Username: govmomitest.SimulatorServerSudoerUsername,
-		Password: govmomitest.SimulatorServerSudoerPassword,
-		Insecure: true,
-	}
+	b.connection(defaultConnectionName).settings = getTestBackendSettings()
 	// mockProvider := newMockProvider()
 	// b.getProvider = func(s *clientSettings) (VSphereProvider, error) {
 	// 	return mockProvider, nil
@@ -56,3 +52,65 @@ func getTestBackend(t *testing.T, initConfig bool) (*vsphereSecretBackend, logic
 
 	return b, config.StorageView
 }
+
+// getTestBackendSettings returns the settings of the sudoer of the simulator.
+func getTestBackendSettings() *clientSettings {
+	return &clientSettings{
+		URL:      govmomitest.SimulatorURL,
+		Username: govmomitest.SimulatorServerSudoerUsername,
+		Password: govmomitest.SimulatorServerSudoerPassword,
+		Insecure: true,
+	}
+}
+
+func TestPeriodicFuncReplication(t *testing.T) {
+	b, s := getTestBackend(t, false)
+	ctx := context.Background()
+
+	// the performance standbys leave the periodic tasks to the primary
+	b.System().(*logical.StaticSystemView).ReplicationStateVal = consts.ReplicationPerformanceStandby
+	nilErr(t, b.periodicFunc(ctx, &logical.Request{Storage: s}))
+	keyring, err := getRoleKeyring(ctx, s)
+	nilErr(t, err)
+	if keyring != nil {
+		t.Fatal("expected the role key not to be rotated on a performance standby")
+	}
+
+	b.System().(*logical.StaticSystemView).ReplicationStateVal = consts.ReplicationPerformancePrimary
+	nilErr(t, b.periodicFunc(ctx, &logical.Request{Storage: s}))
+	keyring, err = getRoleKeyring(ctx, s)
+	nilErr(t, err)
+	if keyring == nil {
+		t.Fatal("expected the role key to be rotated on the primary")
+	}
+}
+
+func TestResetConnection(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, true)
+	ctx := context.Background()
+
+	conn := b.connection(defaultConnectionName)
+	previous, err := b.getClient(ctx, s)
+	nilErr(t, err)
+
+	// a client requested with the entry of a connection reset meanwhile is not cached in it
+	b.resetConnection(defaultConnectionName)
+	if _, err := b.connectionClient(ctx, s, defaultConnectionName, conn); err != errConnectionClosed {
+		t.Fatalf("expected the closed connection to be refused, got %v", err)
+	}
+	if conn.client != nil {
+		t.Fatal("expected no client to be cached in the closed connection")
+	}
+
+	c, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	if c == previous {
+		t.Fatal("expected a new client")
+	}
+	if b.cachedConnectionClient(defaultConnectionName) != c {
+		t.Fatal("expected the new client to be cached in the new connection")
+	}
+}
@@ -2,30 +2,80 @@ package vspheresecrets
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/sts"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
 )
 
 const (
-	retryTimeout   = 80 * time.Second
-	clientLifetime = 30 * time.Minute // copied from azure... is this relevant here?
+	// retryTimeout bounds the time spent retrying a call.
+	retryTimeout = 80 * time.Second
+
+	defaultRequestTimeout = 30 * time.Second
+	defaultMaxRetries     = 3
+	defaultRetryBackoff   = 1 * time.Second
+
+	// sessionCheckInterval is how long a client is used before its session is checked to be still active.
+	sessionCheckInterval = 1 * time.Minute
+
+	thumbprintDialTimeout = 10 * time.Second
 )
 
 // clientSettings is used by a client to configure the connections to Azure.
 // It is created from a combination of Vault config settings and environment variables.
 type clientSettings struct {
+	// URL is the endpoint the client connects to. URLs are the ordered endpoints of a
+	// vCenter HA deployment that are tried in turn when the connection fails.
 	URL       string
+	URLs      []string
 	Username  string
 	Password  string
 	Insecure  bool
 	PluginEnv *logical.PluginEnvironment
+
+	// SolutionCertificate is the solution user's certificate and private key.
+	// When set, the mount logs in with an STS token instead of a password.
+	SolutionCertificate *tls.Certificate
+
+	// RootCAs verifies the server certificates when defined.
+	RootCAs *x509.CertPool
+	// Thumbprints pins the SHA-1 thumbprints of the trusted server certificates.
+	// When defined, they take precedence over the certificate chain verification.
+	Thumbprints []string
+
+	// STSURL and LookupURL override the SSO endpoints discovered through the lookup service.
+	STSURL    string
+	LookupURL string
+
+	// RequestTimeout bounds each call. MaxRetries and RetryBackoff configure
+	// the retries of the idempotent calls failing with a transient error.
+	RequestTimeout time.Duration
+	MaxRetries     int
+	RetryBackoff   time.Duration
+
+	// ProxyURL is the proxy of the connections, except for the hosts matching the NoProxy patterns.
+	ProxyURL *url.URL
+	NoProxy  []string
 }
 
 func (settings *clientSettings) makeLoginURL(username, password string) *url.URL {
@@ -39,20 +89,188 @@ func (settings *clientSettings) makeLoginURL(username, password string) *url.URL
 	return vURL
 }
 
+// Userinfo returns the username and password of the mount, or else the userinfo of the URL.
 func (settings *clientSettings) Userinfo() *url.Userinfo {
-	return url.UserPassword(settings.Username, settings.Password)
+	if settings.Username != "" {
+		return url.UserPassword(settings.Username, settings.Password)
+	}
+	return settings.makeLoginURL("", "").User
+}
+
+// makeSoapClient returns a soap client configured with the TLS trust of the settings.
+// The clients derived from it, such as the STS and lookup service clients, share this configuration.
+func (settings *clientSettings) makeSoapClient(u *url.URL) *soap.Client {
+	soapClient := soap.NewClient(u, settings.Insecure)
+	soapClient.Timeout = settings.RequestTimeout
+	settings.applyProxy(soapClient.Transport)
+	if settings.Insecure {
+		return soapClient
+	}
+
+	tlsConfig := soapClient.Client.Transport.(*http.Transport).TLSClientConfig
+	if settings.RootCAs != nil {
+		tlsConfig.RootCAs = settings.RootCAs
+	}
+	if len(settings.Thumbprints) != 0 {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = settings.verifyThumbprint
+	}
+	return soapClient
+}
+
+// verifyThumbprint checks the server certificate against the pinned thumbprints.
+func (settings *clientSettings) verifyThumbprint(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no server certificate presented")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return err
+	}
+	actual := soap.ThumbprintSHA1(cert)
+	if strutil.StrListContains(settings.Thumbprints, actual) {
+		return nil
+	}
+	return fmt.Errorf("server certificate thumbprint mismatch: expected %s, actual %s", strings.Join(settings.Thumbprints, " or "), actual)
 }
 
 // makeGovmomiClient returns a new govmomi client. If no username is passed, then no authentication takes place as documented in govmomi.NewClient.
 func (settings *clientSettings) makeGovmomiClient(ctx context.Context, username, password string) (*govmomi.Client, error) {
 	u := settings.makeLoginURL(username, password)
-	client, err := govmomi.NewClient(ctx, u, settings.Insecure)
-	return client, err
+	vimClient, err := vim25.NewClient(ctx, settings.makeSoapClient(u))
+	if err != nil {
+		return nil, err
+	}
+	vimClient.RoundTripper = settings.withRetries(vimClient.RoundTripper)
+
+	client := &govmomi.Client{
+		Client:         vimClient,
+		SessionManager: session.NewManager(vimClient),
+	}
+	if u.User != nil {
+		if err := client.Login(ctx, u.User); err != nil {
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// makeVimClient returns a vim25 client that is not logged in.
+// When a solution certificate is configured it is presented by the underlying soap client.
+func (settings *clientSettings) makeVimClient(ctx context.Context) (*vim25.Client, error) {
+	soapClient := settings.makeSoapClient(settings.makeLoginURL("", ""))
+	if settings.SolutionCertificate != nil {
+		soapClient.SetCertificate(*settings.SolutionCertificate)
+	}
+	return vim25.NewClient(ctx, soapClient)
+}
+
+// loginByToken logs in the client with a holder-of-key token issued by the STS
+// for the configured solution certificate.
+func (settings *clientSettings) loginByToken(ctx context.Context, c *govmomi.Client) error {
+	endpoints, err := settings.resolveSSOEndpoints(ctx, c.Client)
+	if err != nil {
+		return err
+	}
+	stsClient := settings.newSTSClient(c.Client, endpoints)
+
+	req := sts.TokenRequest{
+		Certificate: settings.SolutionCertificate,
+		Renewable:   true,
+		Delegatable: true,
+	}
+	signer, err := stsClient.Issue(ctx, req)
+	if err != nil {
+		return errwrap.Wrapf("error issuing solution token: {{err}}", err)
+	}
+
+	header := soap.Header{Security: signer}
+	return c.SessionManager.LoginByToken(c.Client.WithHeader(ctx, header))
+}
+
+// login logs in the client with the credentials of the mount:
+// the solution certificate when defined, otherwise the username and password.
+func (settings *clientSettings) login(ctx context.Context, c *govmomi.Client) error {
+	if settings.SolutionCertificate != nil {
+		return settings.loginByToken(ctx, c)
+	}
+	return c.Login(ctx, settings.Userinfo())
+}
+
+// hasCredentials returns whether the mount has credentials to login with.
+func (settings *clientSettings) hasCredentials() bool {
+	return settings.SolutionCertificate != nil || settings.Userinfo() != nil
+}
+
+// makeMountGovmomiClient returns a govmomi client authenticated with the credentials of the mount.
+// The client logs in again transparently when its session is no longer authenticated.
+// When the mount has no credentials, the client is not logged in.
+func (settings *clientSettings) makeMountGovmomiClient(ctx context.Context) (*govmomi.Client, *reloginRoundTripper, error) {
+	vimClient, err := settings.makeVimClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &govmomi.Client{
+		Client:         vimClient,
+		SessionManager: session.NewManager(vimClient),
+	}
+	if !settings.hasCredentials() {
+		vimClient.RoundTripper = settings.withRetries(vimClient.RoundTripper)
+		return c, nil, nil
+	}
+
+	if err := settings.login(ctx, c); err != nil {
+		return nil, nil, err
+	}
+	// a call is retried after logging in again when the session was not authenticated
+	rt := newReloginRoundTripper(vimClient.RoundTripper, func(ctx context.Context) error {
+		return settings.login(ctx, c)
+	})
+	vimClient.RoundTripper = settings.withRetries(rt)
+
+	return c, rt, nil
+}
+
+// fetchServerThumbprint connects to the server of the URL without verifying its certificate
+// and returns the SHA-1 thumbprint of the certificate it presents.
+func (settings *clientSettings) fetchServerThumbprint(ctx context.Context, rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("the scheme of '%s' is not https", redactURL(rawURL))
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host += ":443"
+	}
+
+	dialer := &net.Dialer{Timeout: thumbprintDialTimeout}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+	conn, err := dialTLS(ctx, dialer, settings.proxyFunc(), u, host, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("no server certificate presented")
+	}
+	return soap.ThumbprintSHA1(certs[0]), nil
 }
 
 // getClientSettings creates a new clientSettings object.
-// Environment variables have higher precedence than stored configuration.
-func (b *vsphereSecretBackend) getClientSettings(ctx context.Context, config *vsphereConfig) (*clientSettings, error) {
+// Environment variables have higher precedence than stored configuration of the default connection.
+func (b *vsphereSecretBackend) getClientSettings(ctx context.Context, name string, config *vsphereConfig) (*clientSettings, error) {
+	getenv := os.Getenv
+	if name != defaultConnectionName {
+		getenv = func(string) string { return "" }
+	}
+
 	firstAvailable := func(opts ...string) string {
 		for _, s := range opts {
 			if s != "" {
@@ -64,15 +282,51 @@ func (b *vsphereSecretBackend) getClientSettings(ctx context.Context, config *vs
 
 	settings := new(clientSettings)
 
-	settings.URL = firstAvailable(os.Getenv("GOVMOMI_URL"), config.URL)
+	settings.URL = firstAvailable(getenv("GOVMOMI_URL"), config.URL)
 	if settings.URL == "" {
 		return nil, errors.New("url is required")
 	}
-	settings.Username = firstAvailable(os.Getenv("GOVMOMI_USERNAME"), config.Username)
-	settings.Password = firstAvailable(os.Getenv("GOVMOMI_PASSWORD"), config.Password)
-	insecureEnv := os.Getenv("GOVMOMI_INSECURE")
+	settings.URLs = []string{settings.URL}
+	if getenv("GOVMOMI_URL") == "" && len(config.URLs) != 0 {
+		settings.URLs = config.URLs
+	}
+	settings.Username = firstAvailable(getenv("GOVMOMI_USERNAME"), config.Username)
+	settings.Password = firstAvailable(getenv("GOVMOMI_PASSWORD"), config.Password)
+	insecureEnv := getenv("GOVMOMI_INSECURE")
 	if insecureEnv != "" {
 		settings.Insecure = insecureEnv == "1" || strings.ToLower(insecureEnv) == "true"
+	} else {
+		settings.Insecure = config.Insecure
+	}
+
+	if config.Certificate != "" {
+		cert, err := tls.X509KeyPair([]byte(config.Certificate), []byte(config.PrivateKey))
+		if err != nil {
+			return nil, errwrap.Wrapf("error loading solution certificate: {{err}}", err)
+		}
+		settings.SolutionCertificate = &cert
+	}
+
+	if config.CACert != "" {
+		settings.RootCAs = x509.NewCertPool()
+		if !settings.RootCAs.AppendCertsFromPEM([]byte(config.CACert)) {
+			return nil, errors.New("no valid certificate found in ca_cert")
+		}
+	}
+	settings.Thumbprints = parseThumbprints(config.Thumbprint)
+	settings.STSURL = config.STSURL
+	settings.LookupURL = config.LookupURL
+	settings.RequestTimeout = durationOrDefault(config.RequestTimeout, defaultRequestTimeout)
+	settings.MaxRetries = config.MaxRetries
+	settings.RetryBackoff = durationOrDefault(config.RetryBackoff, defaultRetryBackoff)
+
+	if config.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, errwrap.Wrapf("error parsing proxy_url: {{err}}", err)
+		}
+		settings.ProxyURL = proxyURL
+		settings.NoProxy = strutil.ParseDedupAndSortStrings(config.NoProxy, ",")
 	}
 
 	pluginEnv, err := b.System().PluginEnv(ctx)
@@ -84,64 +338,358 @@ func (b *vsphereSecretBackend) getClientSettings(ctx context.Context, config *vs
 	return settings, nil
 }
 
+// durationOrDefault returns the duration unless it is zero.
+func durationOrDefault(d, defaultDuration time.Duration) time.Duration {
+	if d == 0 {
+		return defaultDuration
+	}
+	return d
+}
+
 // client offers higher level vSphere operations that provide a simpler interface
 // for handlers. It in turn relies on a Provider interface to access the lower level
 // vSphere Client SDK methods.
 type client struct {
-	provider   VSphereProvider
-	settings   *clientSettings
-	expiration time.Time
+	provider  VSphereProvider
+	settings  *clientSettings
+	connected time.Time
+	checked   time.Time
+
+	endpointsLock sync.Mutex
+	endpoints     []vcenterEndpoint
 }
 
-// Valid returns whether the client defined and not expired.
+// Valid returns whether the client is defined and its session was checked recently.
 func (c *client) Valid() bool {
-	return c != nil && time.Now().Before(c.expiration)
+	return c != nil && time.Since(c.checked) < sessionCheckInterval
 }
 
-func (b *vsphereSecretBackend) getClient(ctx context.Context, s logical.Storage) (*client, error) {
+// vsphereConnection caches the settings and client of a vCenter connection.
+type vsphereConnection struct {
+	lock     sync.RWMutex
+	settings *clientSettings
+	client   *client
+	// activeURL is the last URL the connection succeeded with.
+	activeURL string
+	// closed is set once the entry is removed from the cache and its client logged out: no client
+	// is cached in it anymore.
+	closed bool
+}
+
+// errConnectionClosed is returned for a cache entry closed while its client was requested.
+var errConnectionClosed = errors.New("the connection was closed")
+
+// connection returns the cache entry of the named connection, creating it when needed.
+func (b *vsphereSecretBackend) connection(name string) *vsphereConnection {
 	b.lock.RLock()
-	unlockFunc := b.lock.RUnlock
-	defer func() { unlockFunc() }()
+	conn, ok := b.connections[name]
+	b.lock.RUnlock()
+	if ok {
+		return conn
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if conn, ok = b.connections[name]; !ok {
+		conn = new(vsphereConnection)
+		b.connections[name] = conn
+	}
+	return conn
+}
+
+// vcenterEndpoints returns the vCenters of the SSO domain, as discovered once by the lookup service.
+func (c *client) vcenterEndpoints(ctx context.Context) ([]vcenterEndpoint, error) {
+	c.endpointsLock.Lock()
+	defer c.endpointsLock.Unlock()
 
-	if b.client.Valid() {
-		return b.client, nil
+	if c.endpoints != nil {
+		return c.endpoints, nil
 	}
 
+	endpoints, err := c.provider.ListVCenterEndpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.endpoints = endpoints
+	return endpoints, nil
+}
+
+// endpointURLs returns the URLs of the vCenters of the SSO domain.
+// When no lookup service is available, such as with an ESX host, only the URL of the connection is returned.
+func (c *client) endpointURLs(ctx context.Context) []string {
+	endpoints, err := c.vcenterEndpoints(ctx)
+	if err != nil || len(endpoints) == 0 {
+		return []string{c.settings.makeLoginURL("", "").String()}
+	}
+
+	urls := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		urls[i] = e.URL
+	}
+	return urls
+}
+
+// cachedConnectionClient returns the client of the named connection when it is already established, without logging in.
+func (b *vsphereSecretBackend) cachedConnectionClient(name string) *client {
+	b.lock.RLock()
+	conn, ok := b.connections[name]
 	b.lock.RUnlock()
-	b.lock.Lock()
-	unlockFunc = b.lock.Unlock
+	if !ok {
+		return nil
+	}
+
+	conn.lock.RLock()
+	defer conn.lock.RUnlock()
+	return conn.client
+}
+
+// getClient returns the client of the default connection.
+func (b *vsphereSecretBackend) getClient(ctx context.Context, s logical.Storage) (*client, error) {
+	return b.getConnectionClient(ctx, s, defaultConnectionName)
+}
+
+// getConnectionClient returns the client of the named connection.
+func (b *vsphereSecretBackend) getConnectionClient(ctx context.Context, s logical.Storage, name string) (*client, error) {
+	for {
+		// a connection reset meanwhile is replaced by a new cache entry
+		c, err := b.connectionClient(ctx, s, name, b.connection(name))
+		if err != errConnectionClosed {
+			return c, err
+		}
+	}
+}
+
+// connectionClient returns the client cached in the entry of a connection, logging in when needed.
+func (b *vsphereSecretBackend) connectionClient(ctx context.Context, s logical.Storage, name string, conn *vsphereConnection) (*client, error) {
+	conn.lock.RLock()
+	unlockFunc := conn.lock.RUnlock
+	defer func() { unlockFunc() }()
+
+	if conn.client.Valid() {
+		return conn.client, nil
+	}
 
-	if b.client.Valid() {
-		return b.client, nil
+	conn.lock.RUnlock()
+	conn.lock.Lock()
+	unlockFunc = conn.lock.Unlock
+
+	if conn.closed {
+		return nil, errConnectionClosed
+	}
+	if conn.client.Valid() {
+		return conn.client, nil
 	}
 
-	if b.settings == nil {
-		config, err := b.getConfig(ctx, s)
+	if conn.client != nil {
+		active, err := conn.client.provider.SessionIsActive(ctx)
+		if err == nil && active {
+			conn.client.checked = time.Now()
+			return conn.client, nil
+		}
+		b.closeClient(ctx, conn.client)
+		conn.client = nil
+	}
+
+	if conn.settings == nil {
+		config, err := b.getConnectionConfig(ctx, s, name)
 		if err != nil {
 			return nil, err
 		}
 		if config == nil {
-			config = new(vsphereConfig)
+			if name != defaultConnectionName {
+				return nil, fmt.Errorf("connection '%s' is not configured", name)
+			}
+			config = newVSphereConfig()
 		}
 
-		settings, err := b.getClientSettings(ctx, config)
+		settings, err := b.getClientSettings(ctx, name, config)
 		if err != nil {
 			return nil, err
 		}
-		b.settings = settings
+		conn.settings = settings
 	}
 
-	p, err := b.getProvider(ctx, b.settings)
+	p, settings, err := b.connectAny(ctx, conn.settings, conn.activeURL)
 	if err != nil {
 		return nil, err
 	}
+	conn.activeURL = settings.URL
 
+	now := time.Now()
 	c := &client{
-		provider:   p,
-		settings:   b.settings,
-		expiration: time.Now().Add(clientLifetime),
+		provider:  p,
+		settings:  settings,
+		connected: now,
+		checked:   now,
 	}
-	b.client = c
+	conn.client = c
 
 	return c, nil
 }
+
+// connectAny returns a provider connected to the first of the URLs of the settings that succeeds,
+// starting with the preferred URL, along with the settings of that URL.
+func (b *vsphereSecretBackend) connectAny(ctx context.Context, settings *clientSettings, preferred string) (VSphereProvider, *clientSettings, error) {
+	urls := settings.URLs
+	if len(urls) == 0 {
+		urls = []string{settings.URL}
+	}
+	if strutil.StrListContains(urls, preferred) {
+		urls = append([]string{preferred}, strutil.StrListDelete(urls, preferred)...)
+	}
+
+	var merr *multierror.Error
+	for _, u := range urls {
+		s := *settings
+		s.URL = u
+		p, err := b.getProvider(ctx, &s, b.Logger())
+		if err == nil {
+			return p, &s, nil
+		}
+		merr = multierror.Append(merr, errwrap.Wrapf(fmt.Sprintf("%s: {{err}}", redactURL(u)), err))
+	}
+	if len(urls) == 1 {
+		return nil, nil, merr.Errors[0]
+	}
+	return nil, nil, merr
+}
+
+// redactURL returns the URL without its userinfo.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
+
+// closeClient logs out the session of a client that is no longer used.
+func (b *vsphereSecretBackend) closeClient(ctx context.Context, c *client) {
+	if err := c.provider.Close(ctx); err != nil {
+		b.Logger().Warn("error logging out of vSphere", "url", c.settings.URL, "error", err)
+	}
+}
+
+// createUser creates the SSO user of a lease in its groups and grants its permissions.
+// The description identifies the users created by the mount.
+func (c *client) createUser(ctx context.Context, user *dynamicUser, password, description string) error {
+	if err := c.provider.CreateUser(ctx, user.Username, password, description, user.Groups); err != nil {
+		return errwrap.Wrapf("error creating the user: {{err}}", err)
+	}
+	if err := c.provider.GrantPermissions(ctx, user.Username, user.Permissions); err != nil {
+		return errwrap.Wrapf("error granting the permissions: {{err}}", err)
+	}
+	return nil
+}
+
+// deleteUser revokes the permissions of the SSO user of a lease and deletes it with its group memberships.
+// The steps that did not happen are skipped, so that a partially created user is deleted as well.
+func (c *client) deleteUser(ctx context.Context, user *dynamicUser) error {
+	if err := c.provider.RevokePermissions(ctx, user.Username, user.Permissions); err != nil {
+		return errwrap.Wrapf("error revoking the permissions: {{err}}", err)
+	}
+	if err := c.provider.DeleteUser(ctx, user.Username); err != nil {
+		return errwrap.Wrapf("error deleting the user: {{err}}", err)
+	}
+	return nil
+}
+
+// resolveBindings resolves the tags of the bindings of a role to the bindings of the tagged objects.
+// A single vSphere role can be granted on each object: an object tagged for several roles is rejected.
+func (c *client) resolveBindings(ctx context.Context, role *roleEntry) ([]roleBinding, error) {
+	vc := c.provider.GetMountGovmomiClient()
+
+	var resolved []roleBinding
+	granted := make(map[string]string)
+	for _, binding := range role.bindings() {
+		if binding.Tag == nil {
+			resolved = append(resolved, binding)
+			continue
+		}
+		refs, err := c.provider.ListTaggedObjects(ctx, binding.Tag.Category, binding.Tag.Tag)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("error listing the objects tagged '%s': {{err}}", binding.Tag), err)
+		}
+		for _, ref := range refs {
+			if previous, ok := granted[ref.String()]; ok {
+				if previous != binding.Role {
+					return nil, fmt.Errorf("vSphere roles '%s' and '%s' are both granted on '%s'", previous, binding.Role, ref)
+				}
+				continue
+			}
+			granted[ref.String()] = binding.Role
+
+			entities, err := mo.Ancestors(ctx, vc.Client, vc.ServiceContent.PropertyCollector, ref)
+			if err != nil {
+				return nil, errwrap.Wrapf(fmt.Sprintf("error resolving the inventory path of '%s': {{err}}", ref), err)
+			}
+			var names []string
+			for _, e := range entities[1:] {
+				names = append(names, e.Name)
+			}
+			resolved = append(resolved, roleBinding{
+				Role:   binding.Role,
+				Path:   normalizeInventoryPath(strings.Join(names, "/")),
+				Tag:    binding.Tag,
+				Entity: ref.String(),
+			})
+		}
+	}
+	return resolved, nil
+}
+
+// rolePermissions resolves the inventory paths of the bindings of a role into the permissions of its dynamic users.
+// The roles granted on the root folder, such as the role created for the privileges, propagate to the whole inventory.
+func (c *client) rolePermissions(ctx context.Context, bindings []roleBinding) ([]vspherePermission, error) {
+	vc := c.provider.GetMountGovmomiClient()
+	index := object.NewSearchIndex(vc.Client)
+
+	var permissions []vspherePermission
+	for _, binding := range bindings {
+		if binding.Entity != "" {
+			permissions = append(permissions, vspherePermission{Entity: binding.Entity, Role: binding.Role})
+			continue
+		}
+		entity := vc.ServiceContent.RootFolder
+		if binding.Path != "/" {
+			ref, err := index.FindByInventoryPath(ctx, binding.Path)
+			if err != nil {
+				return nil, errwrap.Wrapf(fmt.Sprintf("error looking up '%s': {{err}}", binding.Path), err)
+			}
+			if ref == nil {
+				return nil, fmt.Errorf("inventory object '%s' does not exist", binding.Path)
+			}
+			entity = ref.Reference()
+		}
+		permissions = append(permissions, vspherePermission{Entity: entity.String(), Role: binding.Role})
+	}
+	return permissions, nil
+}
+
+// savePrivilegeRole creates or updates the vSphere role owned by a Vault role with its privileges.
+// It returns the privileges that vCenter does not define, without saving the role.
+func (c *client) savePrivilegeRole(ctx context.Context, name string, privileges []string) ([]string, error) {
+	defined, err := c.provider.ListPrivileges(ctx)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing the privileges: {{err}}", err)
+	}
+	ids := make(map[string]bool, len(defined))
+	for _, privilege := range defined {
+		ids[privilege.PrivId] = true
+	}
+	var unknown []string
+	for _, privilege := range privileges {
+		if !ids[privilege] {
+			unknown = append(unknown, privilege)
+		}
+	}
+	if len(unknown) != 0 {
+		return unknown, nil
+	}
+
+	if err := c.provider.CreateOrUpdateRole(ctx, name, privileges); err != nil {
+		return nil, errwrap.Wrapf(fmt.Sprintf("error saving the vSphere role '%s': {{err}}", name), err)
+	}
+	return nil, nil
+}
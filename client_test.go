@@ -27,7 +27,7 @@ func TestVSphere(t *testing.T) {
 		t.Fatal("The storage must not be nil")
 	}
 	ctx := context.Background()
-	govmomiClient, err := b.settings.makeGovmomiClient(ctx, govmomitest.SimulatorServerSudoerUsername, govmomitest.SimulatorServerSudoerPassword)
+	govmomiClient, err := b.connection(defaultConnectionName).settings.makeGovmomiClient(ctx, govmomitest.SimulatorServerSudoerUsername, govmomitest.SimulatorServerSudoerPassword)
 	nilErr(t, err)
 
 	testListDatacenters(t, govmomiClient)
@@ -50,7 +50,7 @@ func TestVSphere(t *testing.T) {
 	nilErr(t, err)
 	req := sts.TokenRequest{
 		// Certificate: c.Certificate(),
-		Userinfo:    b.settings.Userinfo(),
+		Userinfo:    b.connection(defaultConnectionName).settings.Userinfo(),
 		Renewable:   true,
 		Delegatable: true,
 		// ActAs:       cmd.token != "",
@@ -65,7 +65,7 @@ func TestVSphere(t *testing.T) {
 	// The simulator is limited with regard to supporting multiple sessions.
 	// we test straight against a brand new session manager... as demonstrated by govmomi/sts/client_test.go
 	ctx3 := context.Background() // must use a separate context to guarantee independence
-	vimClientNotLogged, err := vim25.NewClient(ctx, soap.NewClient(b.settings.makeLoginURL("", ""), true))
+	vimClientNotLogged, err := vim25.NewClient(ctx, soap.NewClient(b.connection(defaultConnectionName).settings.makeLoginURL("", ""), true))
 	err = session.NewManager(vimClientNotLogged).LoginByToken(vimClientNotLogged.WithHeader(ctx3, header))
 	if err != nil {
 		t.Fatal(err)
@@ -87,7 +87,7 @@ func testListDatacenters(tb testing.TB, govmomiClient *govmomi.Client) {
 func makeGovmomiClientFromToken(ctx context.Context, b *vsphereSecretBackend, signer *sts.Signer) (*govmomi.Client, error) {
 	header := soap.Header{Security: signer}
 
-	vimClient, err := vim25.NewClient(ctx, soap.NewClient(b.settings.makeLoginURL("", ""), true))
+	vimClient, err := vim25.NewClient(ctx, soap.NewClient(b.connection(defaultConnectionName).settings.makeLoginURL("", ""), true))
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,7 @@
 package govmomitest
 
 import (
+	"crypto/tls"
 	"net/url"
 	"testing"
 	"time"
@@ -35,7 +36,7 @@ var SimulatorURL string
 var simulatorConfig map[string]interface{}
 
 // CreateSimulator sets up a govmomi simulator model configured with a user
-func createSimulator(t *testing.T) *simulator.Model {
+func createSimulator(t *testing.T, withTLS bool) *simulator.Model {
 	// Default vCenter model. We may end-up customizing this.
 	model := simulator.VPX()
 
@@ -51,16 +52,28 @@ func createSimulator(t *testing.T) *simulator.Model {
 	}
 
 	model.Service.RegisterEndpoints = true
+	if withTLS {
+		model.Service.TLS = new(tls.Config)
+	}
 
 	return model
 }
 
 // Setup creates a simulator if not in place
 func Setup(t *testing.T) *simulator.Server {
+	return setup(t, false)
+}
+
+// SetupTLS creates a simulator served over https with a self-signed certificate if not in place
+func SetupTLS(t *testing.T) *simulator.Server {
+	return setup(t, true)
+}
+
+func setup(t *testing.T, withTLS bool) *simulator.Server {
 	if server != nil {
 		return server
 	}
-	model = createSimulator(t)
+	model = createSimulator(t, withTLS)
 	if model != nil {
 		server = model.Service.NewServer()
 		if server != nil {
@@ -86,10 +99,23 @@ func TearDown() {
 	if model != nil {
 		model.Remove()
 	}
+	server = nil
+	model = nil
 	simulatorConfig = nil
 	SimulatorURL = ""
 }
 
+// SimulatorURLWithoutUserinfo URL of the vSphere endpoint backed by the simulator, without the credentials
+func SimulatorURLWithoutUserinfo() string {
+	if server == nil {
+		return ""
+	}
+	u := *server.URL
+	u.User = nil
+	return u.String()
+}
+
+// GetSimulatorConfig returns the config parameters of the vSphere secrets that match the simulator
 func GetSimulatorConfig(withPassword bool) map[string]interface{} {
 	cfg := make(map[string]interface{})
 	for k, v := range simulatorConfig {
@@ -0,0 +1,146 @@
+package vspheresecrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// builtinAdminGroups are the groups of the SSO domain that grant administrative rights on vCenter or on the
+// SSO domain itself. The roles can never add their users to them, whatever the guardrails.
+var builtinAdminGroups = []string{
+	"Administrators",
+	"ActAsUsers",
+	"CAAdmins",
+	"ComponentManager.Administrators",
+	"LicenseService.Administrators",
+	"SolutionUsers",
+	"SystemConfiguration.Administrators",
+	"SystemConfiguration.BashShellAdministrators",
+	"TrustedAdmins",
+}
+
+// roleGuardrailViolations returns the bindings and the groups of a role that violate the guardrails of the mount
+// and of its connection.
+// The bindings of the tags and of the targets, without a path, are only checked against the allowed paths
+// once resolved to the tagged objects and to the target of a credentials request.
+// The privileges of the vSphere roles are resolved from vCenter, except for the roles in pending whose privileges
+// are about to be saved, such as the vSphere role of the privileges of a role being written.
+func (b *vsphereSecretBackend) roleGuardrailViolations(ctx context.Context, s logical.Storage, connection string, bindings []roleBinding, groups []string, pending map[string][]string) ([]string, error) {
+	if len(bindings) == 0 && len(groups) == 0 {
+		return nil, nil
+	}
+
+	names := []string{defaultConnectionName}
+	if connection != defaultConnectionName {
+		names = append(names, connection)
+	}
+	var policies []*vsphereConfig
+	for _, name := range names {
+		config, err := b.getConnectionConfig(ctx, s, name)
+		if err != nil {
+			return nil, err
+		}
+		if config != nil {
+			policies = append(policies, config)
+		}
+	}
+
+	var violations []string
+	for _, group := range groups {
+		if groupListContains(builtinAdminGroups, group) {
+			violations = strutil.AppendIfMissing(violations, fmt.Sprintf("group '%s' is a built-in administrators group", group))
+		}
+	}
+
+	resolve := false
+	for _, policy := range policies {
+		for _, group := range groups {
+			if groupListContains(policy.ForbiddenGroups, group) {
+				violations = strutil.AppendIfMissing(violations, fmt.Sprintf("group '%s' is forbidden", group))
+			}
+		}
+		for _, binding := range bindings {
+			path := normalizeInventoryPath(binding.Path)
+			if binding.Path != "" && len(policy.AllowedPaths) != 0 && !inventoryPathAllowed(policy.AllowedPaths, path) {
+				violations = strutil.AppendIfMissing(violations,
+					fmt.Sprintf("vSphere role '%s' is granted on '%s', outside of the allowed_paths", binding.Role, path))
+			}
+			if strutil.StrListContains(policy.ForbiddenRoles, binding.Role) {
+				violations = strutil.AppendIfMissing(violations, fmt.Sprintf("vSphere role '%s' is forbidden", binding.Role))
+			}
+		}
+		resolve = resolve || len(policy.ForbiddenPrivileges) != 0
+	}
+	if !resolve || len(bindings) == 0 {
+		return violations, nil
+	}
+
+	privileges := make(map[string][]string)
+	client, err := b.getConnectionClient(ctx, s, connection)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := client.provider.ListRoles(ctx)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing the vSphere roles: {{err}}", err)
+	}
+	for _, r := range roles {
+		privileges[r.Name] = r.Privilege
+	}
+	for name, p := range pending {
+		privileges[name] = p
+	}
+
+	for _, policy := range policies {
+		for _, binding := range bindings {
+			var forbidden []string
+			for _, privilege := range privileges[binding.Role] {
+				if strutil.StrListContains(policy.ForbiddenPrivileges, privilege) {
+					forbidden = append(forbidden, privilege)
+				}
+			}
+			if len(forbidden) != 0 {
+				violations = strutil.AppendIfMissing(violations,
+					fmt.Sprintf("vSphere role '%s' grants the forbidden privileges %s", binding.Role, strings.Join(forbidden, ", ")))
+			}
+		}
+	}
+	return violations, nil
+}
+
+// inventoryPathAllowed returns true when a normalized inventory path is in one of the allowed subtrees.
+func inventoryPathAllowed(allowed []string, path string) bool {
+	for _, root := range allowed {
+		if root == "/" || path == root || strings.HasPrefix(path, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// groupListContains returns true when a list contains a group, compared without their domains and case,
+// as the SSO groups are: Administrators, administrators@vsphere.local and VSPHERE.LOCAL\Administrators are the same.
+func groupListContains(list []string, group string) bool {
+	for _, g := range list {
+		if strings.EqualFold(groupName(g), groupName(group)) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupName returns the name of a group without its domain.
+func groupName(group string) string {
+	if i := strings.LastIndex(group, "@"); i != -1 {
+		group = group[:i]
+	}
+	if i := strings.LastIndex(group, "\\"); i != -1 {
+		group = group[i+1:]
+	}
+	return group
+}
@@ -0,0 +1,135 @@
+package vspheresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+	"github.com/vmware/govmomi/object"
+)
+
+func TestRoleGuardrails(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, true)
+	_ = useMockProvider(b)
+	ctx := context.Background()
+
+	testConfigUpdate(t, b, s, map[string]interface{}{
+		"allowed_paths":        "DC0/vm/",
+		"forbidden_roles":      "Admin",
+		"forbidden_privileges": "Authorization.ModifyPermissions",
+		"forbidden_groups":     "PerfAdmins",
+		"skip_verify":          true,
+	})
+	resp := testRequest(t, b, s, logical.ReadOperation, "config", nil)
+	equal(t, []string{"/DC0/vm"}, resp.Data["allowed_paths"])
+
+	// the config updates reset the client of the mount
+	testAuthz := func(t *testing.T) *object.AuthorizationManager {
+		t.Helper()
+		client, err := b.getClient(ctx, s)
+		nilErr(t, err)
+		return object.NewAuthorizationManager(client.provider.GetMountGovmomiClient().Client)
+	}
+	roleID, err := testAuthz(t).AddRole(ctx, "vault-test-operator", []string{"VirtualMachine.Interact.PowerOn"})
+	nilErr(t, err)
+
+	testRoleCreate(t, b, s, "operator", map[string]interface{}{
+		"vsphere_roles": `{"role_name":"vault-test-operator","folders":["DC0/vm"]}`,
+	})
+	testRequest(t, b, s, logical.ReadOperation, "session/operator", nil)
+
+	t.Run("Rejected", func(t *testing.T) {
+		for _, data := range []map[string]interface{}{
+			// outside of the allowed paths
+			{"vsphere_roles": `{"role_name":"ReadOnly","folders":["DC0/host"]}`},
+			{"vsphere_roles": `{"role_name":"ReadOnly","folders":["DC0/vm2"]}`},
+			{"vsphere_roles": "ReadOnly"},
+			// forbidden role and privileges
+			{"vsphere_roles": `{"role_name":"Admin","folders":["DC0/vm"]}`},
+			// the privileges are granted on the root folder
+			{"privileges": "VirtualMachine.Interact.PowerOn"},
+			// forbidden and built-in administrators groups
+			{"vsphere_roles": `{"role_name":"ReadOnly","folders":["DC0/vm"]}`, "vsphere_groups": "perfadmins@vsphere.local"},
+			{"vsphere_roles": `{"role_name":"ReadOnly","folders":["DC0/vm"]}`, "vsphere_groups": "Administrators"},
+			{"vsphere_groups": `VSPHERE.LOCAL\SystemConfiguration.BashShellAdministrators`},
+		} {
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.CreateOperation,
+				Path:      "roles/rejected",
+				Data:      data,
+				Storage:   s,
+			})
+			nilErr(t, err)
+			if !resp.IsError() {
+				t.Fatalf("expected %v to be rejected", data)
+			}
+			if !strings.Contains(resp.Error().Error(), "guardrails") {
+				t.Fatalf("expected a guardrail violation, got %s", resp.Error())
+			}
+		}
+	})
+
+	t.Run("Target", func(t *testing.T) {
+		// the targets are checked when the credentials are requested
+		testRoleCreate(t, b, s, "targeted", map[string]interface{}{
+			"vsphere_roles":   "vault-test-operator",
+			"allowed_targets": "DC0/*",
+		})
+		testRequest(t, b, s, logical.ReadOperation, "session/targeted", map[string]interface{}{"target": "DC0/vm"})
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "session/targeted",
+			Data:      map[string]interface{}{"target": "DC0/host"},
+			Storage:   s,
+		})
+		nilErr(t, err)
+		if !resp.IsError() || !strings.Contains(resp.Error().Error(), "guardrails") {
+			t.Fatalf("expected a guardrail violation, got %v", resp)
+		}
+	})
+
+	t.Run("Groups", func(t *testing.T) {
+		testRoleCreate(t, b, s, "grouped", map[string]interface{}{
+			"vsphere_roles":  `{"role_name":"ReadOnly","folders":["DC0/vm"]}`,
+			"vsphere_groups": "Operators",
+		})
+		testRequest(t, b, s, logical.ReadOperation, "session/grouped", nil)
+
+		// the groups forbidden after the role is written are checked when the credentials are requested
+		testConfigUpdate(t, b, s, map[string]interface{}{"forbidden_groups": "PerfAdmins,Operators", "skip_verify": true})
+		testSPReadError(t, b, s, "grouped")
+	})
+
+	t.Run("ForbiddenPrivileges", func(t *testing.T) {
+		testConfigUpdate(t, b, s, map[string]interface{}{"allowed_paths": "", "skip_verify": true})
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "roles/rejected",
+			Data:      map[string]interface{}{"privileges": "VirtualMachine.Interact.PowerOn,Authorization.ModifyPermissions"},
+			Storage:   s,
+		})
+		nilErr(t, err)
+		if !resp.IsError() || !strings.Contains(resp.Error().Error(), "Authorization.ModifyPermissions") {
+			t.Fatalf("expected the forbidden privilege to be rejected, got %v", resp)
+		}
+		roles, err := testAuthz(t).RoleList(ctx)
+		nilErr(t, err)
+		for _, role := range roles {
+			if strings.HasPrefix(role.Name, "vault-rejected-") {
+				t.Fatalf("expected the vSphere role of a rejected role not to be created, found %s", role.Name)
+			}
+		}
+	})
+
+	t.Run("Issuance", func(t *testing.T) {
+		// the vSphere role is changed in vCenter after the role is written
+		nilErr(t, testAuthz(t).UpdateRole(ctx, roleID, "vault-test-operator",
+			[]string{"VirtualMachine.Interact.PowerOn", "Authorization.ModifyPermissions"}))
+		testSPReadError(t, b, s, "operator")
+	})
+}
@@ -0,0 +1,186 @@
+package vspheresecrets
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// identityTemplateRegex matches the identity templates, such as {{identity.entity.metadata.team}}.
+var identityTemplateRegex = regexp.MustCompile(`\{\{\s*([^{}]*?)\s*\}\}`)
+
+// hasIdentityTemplate returns true when a string contains identity templates.
+func hasIdentityTemplate(s string) bool {
+	return identityTemplateRegex.MatchString(s)
+}
+
+// identityTemplateField is the kind of role field an identity template is populated in, which restricts
+// the characters of the values.
+type identityTemplateField int
+
+const (
+	// identityTemplateUsername values are limited to the characters of the SSO usernames. A '?' would be
+	// replaced with a random character.
+	identityTemplateUsername identityTemplateField = iota
+	// identityTemplateInventoryPath values can not contain a '/' or the characters of a pattern, so that
+	// they can not select other objects.
+	identityTemplateInventoryPath
+)
+
+// populateIdentityTemplate replaces the identity templates of a string with the values of an entity.
+// The templates are the id, name and metadata.<key> of identity.entity, and the name and metadata.<key>
+// of identity.entity.aliases.<mount accessor>, as in the ACL policies. When the entity is nil, the
+// templates are only validated.
+func populateIdentityTemplate(s string, entity *logical.Entity, field identityTemplateField) (string, error) {
+	var failure error
+	populated := identityTemplateRegex.ReplaceAllStringFunc(s, func(match string) string {
+		if failure != nil {
+			return ""
+		}
+		name := identityTemplateRegex.FindStringSubmatch(match)[1]
+		value, err := identityValue(name, entity)
+		if err == nil && entity != nil && value == "" {
+			err = fmt.Errorf("the value of '%s' is empty", name)
+		}
+		if err == nil && field == identityTemplateUsername && strings.IndexFunc(value, func(r rune) bool {
+			return !strings.ContainsRune(usernameAllowedChars, r)
+		}) != -1 {
+			err = fmt.Errorf("the value of '%s' is not a valid username: it must only contain letters, digits, '-', '_' and '.'", name)
+		}
+		if err == nil && field == identityTemplateInventoryPath && strings.ContainsAny(value, `/*?[\`) {
+			err = fmt.Errorf("the value of '%s' is not a valid inventory path element", name)
+		}
+		failure = err
+		return value
+	})
+	if failure != nil {
+		return "", failure
+	}
+	return populated, nil
+}
+
+// identityValue returns the value of an identity template of an entity, or an empty value when the entity is nil.
+func identityValue(name string, entity *logical.Entity) (string, error) {
+	parts := strings.Split(name, ".")
+	if len(parts) < 3 || parts[0] != "identity" || parts[1] != "entity" {
+		return "", fmt.Errorf("unsupported identity template '%s'", name)
+	}
+
+	switch {
+	case len(parts) == 3 && parts[2] == "id":
+		if entity == nil {
+			return "", nil
+		}
+		return entity.ID, nil
+	case len(parts) == 3 && parts[2] == "name":
+		if entity == nil {
+			return "", nil
+		}
+		return entity.Name, nil
+	case len(parts) == 4 && parts[2] == "metadata":
+		if entity == nil {
+			return "", nil
+		}
+		return entity.Metadata[parts[3]], nil
+	case len(parts) >= 5 && parts[2] == "aliases":
+		// the mount accessors do not contain dots
+		accessor, field := parts[3], parts[4:]
+		if !(len(field) == 1 && field[0] == "name") && !(len(field) == 2 && field[0] == "metadata") {
+			return "", fmt.Errorf("unsupported identity template '%s'", name)
+		}
+		if entity == nil {
+			return "", nil
+		}
+		for _, alias := range entity.Aliases {
+			if alias.MountAccessor != accessor {
+				continue
+			}
+			if len(field) == 1 {
+				return alias.Name, nil
+			}
+			return alias.Metadata[field[1]], nil
+		}
+		return "", fmt.Errorf("the entity has no alias on the mount '%s'", accessor)
+	}
+	return "", fmt.Errorf("unsupported identity template '%s'", name)
+}
+
+// hasIdentityTemplates returns true when the username or the inventory paths of a role contain identity templates.
+func (r *roleEntry) hasIdentityTemplates() bool {
+	if hasIdentityTemplate(r.Username) {
+		return true
+	}
+	for _, target := range r.AllowedTargets {
+		if hasIdentityTemplate(target) {
+			return true
+		}
+	}
+	for _, vr := range r.VSphereRoles {
+		for _, folder := range vr.Folders {
+			if hasIdentityTemplate(folder) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateIdentityTemplates returns an error when the username or the inventory paths of a role contain
+// unsupported identity templates.
+func (r *roleEntry) validateIdentityTemplates() error {
+	_, err := r.withIdentity(nil)
+	return err
+}
+
+// withIdentity returns a copy of a role with the identity templates of its username and of its inventory
+// paths replaced with the values of an entity. When the entity is nil, the templates are only validated.
+func (r *roleEntry) withIdentity(entity *logical.Entity) (*roleEntry, error) {
+	populated := *r
+
+	var err error
+	if populated.Username, err = populateIdentityTemplate(r.Username, entity, identityTemplateUsername); err != nil {
+		return nil, fmt.Errorf("invalid username: %s", err)
+	}
+
+	populated.AllowedTargets = make([]string, len(r.AllowedTargets))
+	for i, target := range r.AllowedTargets {
+		if populated.AllowedTargets[i], err = populateIdentityTemplate(target, entity, identityTemplateInventoryPath); err != nil {
+			return nil, fmt.Errorf("invalid allowed_targets: %s", err)
+		}
+	}
+
+	populated.VSphereRoles = make([]*vsphereRole, len(r.VSphereRoles))
+	for i, vr := range r.VSphereRoles {
+		role := *vr
+		role.Folders = make([]string, len(vr.Folders))
+		for j, folder := range vr.Folders {
+			if role.Folders[j], err = populateIdentityTemplate(folder, entity, identityTemplateInventoryPath); err != nil {
+				return nil, fmt.Errorf("invalid vsphere_roles folder: %s", err)
+			}
+		}
+		populated.VSphereRoles[i] = &role
+	}
+	return &populated, nil
+}
+
+// identityRole returns a role with its identity templates populated with the entity of a request.
+// The roles without identity templates are returned as is.
+func (b *vsphereSecretBackend) identityRole(req *logical.Request, role *roleEntry) (*roleEntry, error) {
+	if !role.hasIdentityTemplates() {
+		return role, nil
+	}
+	if req.EntityID == "" {
+		return nil, errors.New("the role uses identity templates: the request has no entity")
+	}
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if entity == nil {
+		return nil, fmt.Errorf("entity '%s' not found", req.EntityID)
+	}
+	return role.withIdentity(entity)
+}
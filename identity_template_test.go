@@ -0,0 +1,128 @@
+package vspheresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+	"github.com/vmware/govmomi/find"
+)
+
+var testEntity = &logical.Entity{
+	ID:       "entity-id",
+	Name:     "alice",
+	Metadata: map[string]string{"team": "DC0_H0_VM0"},
+	Aliases: []*logical.Alias{
+		{MountAccessor: "auth_userpass_1234", Name: "alice@example.com", Metadata: map[string]string{"dept": "ops"}},
+	},
+}
+
+func TestPopulateIdentityTemplate(t *testing.T) {
+	for template, expected := range map[string]string{
+		"vault-{{identity.entity.name}}-????":                          "vault-alice-????",
+		"{{ identity.entity.id }}":                                     "entity-id",
+		"/dc0/vm/{{identity.entity.metadata.team}}":                    "/dc0/vm/DC0_H0_VM0",
+		"{{identity.entity.aliases.auth_userpass_1234.name}}":          "alice@example.com",
+		"{{identity.entity.aliases.auth_userpass_1234.metadata.dept}}": "ops",
+		"no-template": "no-template",
+	} {
+		populated, err := populateIdentityTemplate(template, testEntity, identityTemplateInventoryPath)
+		nilErr(t, err)
+		equal(t, expected, populated)
+	}
+
+	for _, template := range []string{
+		"{{identity.group.name}}",
+		"{{identity.entity.unknown}}",
+		"{{identity.entity.aliases.auth_userpass_1234.id}}",
+	} {
+		if _, err := populateIdentityTemplate(template, nil, identityTemplateInventoryPath); err == nil {
+			t.Fatalf("expected %s to be rejected", template)
+		}
+	}
+
+	for _, template := range []string{
+		"{{identity.entity.metadata.missing}}",
+		"{{identity.entity.aliases.auth_other.name}}",
+	} {
+		if _, err := populateIdentityTemplate(template, testEntity, identityTemplateInventoryPath); err == nil {
+			t.Fatalf("expected %s to fail without a value", template)
+		}
+	}
+
+	// the values of an inventory path can not select other objects
+	_, err := populateIdentityTemplate("/dc0/vm/{{identity.entity.aliases.auth_userpass_1234.name}}", &logical.Entity{
+		Aliases: []*logical.Alias{{MountAccessor: "auth_userpass_1234", Name: "../*"}},
+	}, identityTemplateInventoryPath)
+	if err == nil {
+		t.Fatal("expected a value with a '/' to be rejected in an inventory path")
+	}
+
+	// the values of a username are not random characters and are valid SSO usernames
+	populated, err := populateIdentityTemplate("vault-{{identity.entity.name}}-????", testEntity, identityTemplateUsername)
+	nilErr(t, err)
+	equal(t, "vault-alice-????", populated)
+	for _, name := range []string{"al?ce", "alice@example.com", "alice smith", `corp\alice`} {
+		if _, err := populateIdentityTemplate("vault-{{identity.entity.name}}-????", &logical.Entity{Name: name}, identityTemplateUsername); err == nil {
+			t.Fatalf("expected the value '%s' to be rejected in a username", name)
+		}
+	}
+}
+
+func TestSPReadIdentityTemplates(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	_ = useMockProvider(b)
+	b.System().(*logical.StaticSystemView).EntityVal = testEntity
+	ctx := context.Background()
+
+	testRoleCreate(t, b, s, "personal", map[string]interface{}{
+		"username":      "vault-{{identity.entity.name}}-????",
+		"vsphere_roles": `{"role_name":"ReadOnly","folders":["DC0/vm/{{identity.entity.metadata.team}}"]}`,
+	})
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "session/personal",
+		Storage:   s,
+		EntityID:  testEntity.ID,
+	})
+	nilErr(t, err)
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+	username := resp.Data["username"].(string)
+	if !strings.HasPrefix(username, "vault-alice-") || len(username) != len("vault-alice-????") {
+		t.Fatalf("unexpected username %s", username)
+	}
+
+	client, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	vm, err := find.NewFinder(client.provider.GetMountGovmomiClient().Client).VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	nilErr(t, err)
+	equal(t, []string{"ReadOnly"}, testUserEntityRoles(t, b, s, username, vm.Reference()))
+
+	// the templates require the entity of the request
+	testSPReadError(t, b, s, "personal")
+
+	for _, data := range []map[string]interface{}{
+		{"username": "vault-{{identity.group.name}}", "vsphere_roles": "ReadOnly"},
+		{"vsphere_roles": `{"role_name":"ReadOnly","folders":["DC0/vm/{{identity.entity.team}}"]}`},
+		{"username": "{{identity.entity.name}}", "password": "secret"},
+	} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "roles/invalid",
+			Data:      data,
+			Storage:   s,
+		})
+		nilErr(t, err)
+		if !resp.IsError() {
+			t.Fatalf("expected %v to be rejected", data)
+		}
+	}
+}
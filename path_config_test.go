@@ -2,10 +2,21 @@ package vspheresecrets
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/soap"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
 )
 
 func TestConfig(t *testing.T) {
@@ -20,14 +31,49 @@ func TestConfig(t *testing.T) {
 
 	// Must not be able to retrieve the password from the read of a config
 	delete(config, "password")
+	config["certificate"] = ""
+	config["ca_cert"] = ""
+	config["thumbprint"] = ""
+	config["tofu"] = false
+	config["sts_url"] = ""
+	config["lookup_url"] = ""
+	config["request_timeout"] = int64(30)
+	config["max_retries"] = 3
+	config["retry_backoff"] = int64(1)
+	config["proxy_url"] = ""
+	config["no_proxy"] = ""
+	config["allowed_paths"] = []string(nil)
+	config["forbidden_roles"] = []string(nil)
+	config["forbidden_privileges"] = []string(nil)
+	config["forbidden_groups"] = []string(nil)
+	config["urls"] = []string{config["url"].(string)}
+	config["active_url"] = govmomitest.SimulatorURLWithoutUserinfo()
+	config["sso_endpoints"] = testSimulatorSSOEndpoints()
+	config["about"] = testSimulatorAbout(t, b, s)
 	testConfigRead(t, b, s, config)
 
+	// Test credentials that fail to login are rejected unless the verification is skipped
+	resp, _ := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data:      map[string]interface{}{"password": "wrong"},
+		Storage:   s,
+	})
+	if !resp.IsError() {
+		t.Fatal("expected a response error")
+	}
+
 	// Test test updating one element retains the others
 	config["username"] = "different"
 	configSubset := map[string]interface{}{
-		"username": config["username"],
+		"username":    config["username"],
+		"skip_verify": true,
 	}
 	testConfigCreate(t, b, s, configSubset)
+	delete(config, "about")
+	delete(config, "active_url")
+	delete(config, "sso_endpoints")
+	config["skip_verify"] = true
 	testConfigUpdate(t, b, s, config)
 
 	// Test bad environment
@@ -35,7 +81,7 @@ func TestConfig(t *testing.T) {
 		"url": "invalidURL",
 	}
 
-	resp, _ := b.HandleRequest(context.Background(), &logical.Request{
+	resp, _ = b.HandleRequest(context.Background(), &logical.Request{
 		Operation: logical.UpdateOperation,
 		Path:      "config",
 		Data:      config,
@@ -59,6 +105,25 @@ func TestConfigDelete(t *testing.T) {
 	testConfigCreate(t, b, s, config)
 
 	delete(config, "password")
+	config["certificate"] = ""
+	config["ca_cert"] = ""
+	config["thumbprint"] = ""
+	config["tofu"] = false
+	config["sts_url"] = ""
+	config["lookup_url"] = ""
+	config["request_timeout"] = int64(30)
+	config["max_retries"] = 3
+	config["retry_backoff"] = int64(1)
+	config["proxy_url"] = ""
+	config["no_proxy"] = ""
+	config["allowed_paths"] = []string(nil)
+	config["forbidden_roles"] = []string(nil)
+	config["forbidden_privileges"] = []string(nil)
+	config["forbidden_groups"] = []string(nil)
+	config["urls"] = []string{config["url"].(string)}
+	config["active_url"] = govmomitest.SimulatorURLWithoutUserinfo()
+	config["sso_endpoints"] = testSimulatorSSOEndpoints()
+	config["about"] = testSimulatorAbout(t, b, s)
 	testConfigRead(t, b, s, config)
 
 	resp, err := b.HandleRequest(context.Background(), &logical.Request{
@@ -74,13 +139,231 @@ func TestConfigDelete(t *testing.T) {
 	}
 
 	config = map[string]interface{}{
-		"url":      "",
-		"username": "",
-		"insecure": false,
+		"url":         "",
+		"urls":        []string(nil),
+		"username":    "",
+		"insecure":    false,
+		"certificate": "",
+		"ca_cert":     "",
+		"thumbprint":  "",
+		"tofu":        false,
+		"sts_url":     "",
+		"lookup_url":  "",
+
+		"request_timeout": int64(30),
+		"max_retries":     3,
+		"retry_backoff":   int64(1),
+		"proxy_url":       "",
+		"no_proxy":        "",
+
+		"allowed_paths":        []string(nil),
+		"forbidden_roles":      []string(nil),
+		"forbidden_privileges": []string(nil),
+		"forbidden_groups":     []string(nil),
 	}
 	testConfigRead(t, b, s, config)
 }
 
+func TestConfigSolutionCertificate(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+
+	certificate, privateKey := generateTestCertificate(t, "vault-solution")
+
+	config := govmomitest.GetSimulatorConfig(false)
+	delete(config, "username")
+	config["certificate"] = certificate
+	config["private_key"] = privateKey
+	testConfigCreate(t, b, s, config)
+
+	// the private key is never returned
+	delete(config, "private_key")
+	config["username"] = ""
+	config["ca_cert"] = ""
+	config["thumbprint"] = ""
+	config["tofu"] = false
+	config["sts_url"] = ""
+	config["lookup_url"] = ""
+	config["request_timeout"] = int64(30)
+	config["max_retries"] = 3
+	config["retry_backoff"] = int64(1)
+	config["proxy_url"] = ""
+	config["no_proxy"] = ""
+	config["allowed_paths"] = []string(nil)
+	config["forbidden_roles"] = []string(nil)
+	config["forbidden_privileges"] = []string(nil)
+	config["forbidden_groups"] = []string(nil)
+	config["urls"] = []string{config["url"].(string)}
+	config["active_url"] = govmomitest.SimulatorURLWithoutUserinfo()
+	config["sso_endpoints"] = testSimulatorSSOEndpoints()
+	config["about"] = testSimulatorAbout(t, b, s)
+	testConfigRead(t, b, s, config)
+
+	// the mount logs in as the solution user
+	b.reset()
+	client, err := b.getClient(context.Background(), s)
+	nilErr(t, err)
+	testListDatacenters(t, client.provider.GetMountGovmomiClient())
+
+	// a certificate without its private key is rejected
+	resp, _ := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"private_key": "",
+		},
+		Storage: s,
+	})
+
+	if !resp.IsError() {
+		t.Fatal("expected a response error")
+	}
+}
+
+func TestConfigTLSTrust(t *testing.T) {
+	server := govmomitest.SetupTLS(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	ctx := context.Background()
+
+	thumbprint := soap.ThumbprintSHA1(server.Certificate())
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	config := govmomitest.GetSimulatorConfig(true)
+	config["insecure"] = false
+
+	t.Run("Untrusted", func(t *testing.T) {
+		resp, _ := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "config",
+			Data:      config,
+			Storage:   s,
+		})
+		if !resp.IsError() {
+			t.Fatal("expected the config write to fail the verification")
+		}
+
+		config["skip_verify"] = true
+		testConfigCreate(t, b, s, config)
+		b.reset()
+		if _, err := b.getClient(ctx, s); err == nil {
+			t.Fatal("expected the self-signed certificate to be rejected")
+		}
+	})
+
+	t.Run("Thumbprint", func(t *testing.T) {
+		testConfigUpdate(t, b, s, map[string]interface{}{"thumbprint": strings.ToLower(thumbprint)})
+		b.reset()
+		client, err := b.getClient(ctx, s)
+		nilErr(t, err)
+		testListDatacenters(t, client.provider.GetMountGovmomiClient())
+
+		// the STS connection trusts the same certificate
+		_, err = client.provider.IssueUserToken(ctx, govmomitest.SimulatorServerSudoerUsername, govmomitest.SimulatorServerSudoerPassword, 0, false, false)
+		nilErr(t, err)
+	})
+
+	t.Run("ThumbprintMismatch", func(t *testing.T) {
+		expected := "00:11:22:33:44:55:66:77:88:99:AA:BB:CC:DD:EE:FF:00:11:22:33"
+		testConfigUpdate(t, b, s, map[string]interface{}{"thumbprint": expected, "skip_verify": true})
+		b.reset()
+		_, err := b.getClient(ctx, s)
+		if err == nil {
+			t.Fatal("expected a thumbprint mismatch")
+		}
+		if !strings.Contains(err.Error(), expected) || !strings.Contains(err.Error(), thumbprint) {
+			t.Fatalf("expected the error to name the expected and actual thumbprints: %s", err)
+		}
+	})
+
+	t.Run("InvalidThumbprint", func(t *testing.T) {
+		resp, _ := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config",
+			Data:      map[string]interface{}{"thumbprint": "not-a-thumbprint"},
+			Storage:   s,
+		})
+		if !resp.IsError() {
+			t.Fatal("expected a response error")
+		}
+	})
+
+	t.Run("CACert", func(t *testing.T) {
+		testConfigUpdate(t, b, s, map[string]interface{}{"thumbprint": "", "ca_cert": caCert})
+		b.reset()
+		client, err := b.getClient(ctx, s)
+		nilErr(t, err)
+		testListDatacenters(t, client.provider.GetMountGovmomiClient())
+	})
+
+	t.Run("TOFU", func(t *testing.T) {
+		testConfigUpdate(t, b, s, map[string]interface{}{"ca_cert": "", "tofu": true})
+		b.reset()
+		stored, err := b.getConfig(ctx, s)
+		nilErr(t, err)
+		equal(t, thumbprint, stored.Thumbprint)
+
+		client, err := b.getClient(ctx, s)
+		nilErr(t, err)
+		testListDatacenters(t, client.provider.GetMountGovmomiClient())
+	})
+}
+
+func TestConfigTOFUExternalPSC(t *testing.T) {
+	server := govmomitest.SetupTLS(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	ctx := context.Background()
+
+	// the Platform Services Controller is another host, with its own certificate, in front of the simulator
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: server.URL.Scheme, Host: server.URL.Host})
+	proxy.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	psc := httptest.NewUnstartedServer(proxy)
+	certPEM, keyPEM := generateTestCertificate(t, "psc")
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	nilErr(t, err)
+	psc.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	psc.StartTLS()
+	defer psc.Close()
+
+	// the vCenter locates the lookup service on the host of its STS
+	settings := getTestBackendSettings()
+	gc, err := settings.makeGovmomiClient(ctx, settings.Username, settings.Password)
+	nilErr(t, err)
+	m := object.NewOptionManager(gc.Client, *gc.ServiceContent.Setting)
+	nilErr(t, m.Update(ctx, []vimtypes.BaseOptionValue{&vimtypes.OptionValue{
+		Key:   "config.vpxd.sso.sts.uri",
+		Value: psc.URL + "/sts/STSService/vsphere.local",
+	}}))
+
+	config := govmomitest.GetSimulatorConfig(true)
+	config["insecure"] = false
+	config["tofu"] = true
+	testConfigCreate(t, b, s, config)
+
+	b.reset()
+	stored, err := b.getConfig(ctx, s)
+	nilErr(t, err)
+	pscCert, err := parseSolutionCertificate(certPEM)
+	nilErr(t, err)
+	equal(t, []string{soap.ThumbprintSHA1(server.Certificate()), soap.ThumbprintSHA1(pscCert)}, parseThumbprints(stored.Thumbprint))
+
+	// the SSO services of the external host are trusted
+	client, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	endpoints, err := client.provider.SSOEndpoints(ctx)
+	nilErr(t, err)
+	if u, _ := url.Parse(endpoints.LookupURL); u == nil || "https://"+u.Host != psc.URL {
+		t.Fatalf("expected the lookup service of the external host, got %s", endpoints.LookupURL)
+	}
+	_, err = client.provider.IssueUserToken(ctx, govmomitest.SimulatorServerSudoerUsername, govmomitest.SimulatorServerSudoerPassword, 0, false, false)
+	nilErr(t, err)
+}
+
 func testConfigCreate(t *testing.T, b logical.Backend, s logical.Storage, d map[string]interface{}) {
 	t.Helper()
 	testConfigCreateUpdate(t, b, logical.CreateOperation, s, d)
@@ -95,14 +378,14 @@ func testConfigCreateUpdate(t *testing.T, b logical.Backend, op logical.Operatio
 	t.Helper()
 
 	// save and restore the client since the config change will clear it
-	settings := b.(*vsphereSecretBackend).settings
+	settings := b.(*vsphereSecretBackend).connection(defaultConnectionName).settings
 	resp, err := b.HandleRequest(context.Background(), &logical.Request{
 		Operation: op,
 		Path:      "config",
 		Data:      d,
 		Storage:   s,
 	})
-	b.(*vsphereSecretBackend).settings = settings
+	b.(*vsphereSecretBackend).connection(defaultConnectionName).settings = settings
 
 	if err != nil {
 		t.Fatal(err)
@@ -129,5 +412,195 @@ func testConfigRead(t *testing.T, b logical.Backend, s logical.Storage, expected
 		t.Fatal(resp.Error())
 	}
 
+	// the connection time is only checked to be recent
+	if connected, ok := resp.Data["last_connection_time"]; ok {
+		ts, err := time.Parse(time.RFC3339, connected.(string))
+		nilErr(t, err)
+		if time.Since(ts) > time.Minute {
+			t.Fatalf("expected a recent connection time, got %s", connected)
+		}
+		delete(resp.Data, "last_connection_time")
+	}
+
 	equal(t, expected, resp.Data)
 }
+
+// testSimulatorAbout returns the AboutInfo of the simulator as returned by the config read.
+func testSimulatorAbout(t *testing.T, b *vsphereSecretBackend, s logical.Storage) map[string]interface{} {
+	t.Helper()
+	client, err := b.getClient(context.Background(), s)
+	nilErr(t, err)
+	about := client.provider.GetMountGovmomiClient().ServiceContent.About
+	return map[string]interface{}{
+		"product":       about.Name,
+		"version":       about.Version,
+		"build":         about.Build,
+		"api_type":      about.ApiType,
+		"api_version":   about.ApiVersion,
+		"instance_uuid": about.InstanceUuid,
+	}
+}
+
+func TestConfigSSOEndpoints(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+
+	endpoints := testSimulatorSSOEndpoints()
+
+	// the configured endpoints are used as is
+	config := govmomitest.GetSimulatorConfig(true)
+	config["sts_url"] = endpoints["sts_url"]
+	config["lookup_url"] = endpoints["lookup_url"]
+	testConfigCreate(t, b, s, config)
+	b.reset()
+
+	// a plain read does not log in
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if _, ok := resp.Data["sso_endpoints"]; ok || len(resp.Warnings) != 0 {
+		t.Fatalf("expected the endpoints of a connection not established not to be reported, got %v", resp)
+	}
+	if b.cachedConnectionClient(defaultConnectionName) != nil {
+		t.Fatal("expected a plain read not to log in")
+	}
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Data:      map[string]interface{}{"verify": true},
+		Storage:   s,
+	})
+	nilErr(t, err)
+	equal(t, endpoints["sts_url"], resp.Data["sts_url"])
+	equal(t, endpoints["lookup_url"], resp.Data["lookup_url"])
+	equal(t, endpoints, resp.Data["sso_endpoints"])
+
+	// tokens are issued by the configured STS
+	client, err := b.getClient(context.Background(), s)
+	nilErr(t, err)
+	_, err = client.provider.IssueUserToken(context.Background(), govmomitest.SimulatorServerSudoerUsername, govmomitest.SimulatorServerSudoerPassword, time.Minute, false, false)
+	nilErr(t, err)
+
+	// an unreachable lookup service is reported without failing the read
+	testConfigCreate(t, b, s, map[string]interface{}{
+		"lookup_url": "http://127.0.0.1:1/lookupservice/sdk",
+	})
+	b.reset()
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Data:      map[string]interface{}{"verify": true},
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if _, ok := resp.Data["sso_endpoints"]; ok {
+		t.Fatal("expected the SSO endpoints not to be resolved")
+	}
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "unable to resolve the SSO endpoints") {
+		t.Fatalf("expected a warning, got %v", resp.Warnings)
+	}
+
+	// the failures to connect are reported as such
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data:      map[string]interface{}{"urls": "http://127.0.0.1:1/sdk", "max_retries": 0, "skip_verify": true},
+		Storage:   s,
+	})
+	nilErr(t, err)
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Data:      map[string]interface{}{"verify": true},
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "unable to connect to vCenter") {
+		t.Fatalf("expected a connection warning, got %v", resp.Warnings)
+	}
+
+	// invalid URLs are rejected
+	resp, _ = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"sts_url": "sts",
+		},
+		Storage: s,
+	})
+	if !resp.IsError() {
+		t.Fatal("expected a response error")
+	}
+}
+
+// testSimulatorSSOEndpoints returns the SSO endpoints registered by the simulator.
+func testSimulatorSSOEndpoints() map[string]interface{} {
+	u := govmomitest.SimulatorURLWithoutUserinfo()
+	base := strings.TrimSuffix(u, "/sdk")
+	return map[string]interface{}{
+		"lookup_url":    base + "/lookupservice/sdk",
+		"sts_url":       base + "/sts/STSService/vsphere.local",
+		"sso_admin_url": base + "/sso-adminserver/sdk",
+	}
+}
+
+func TestConfigURLs(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	ctx := context.Background()
+
+	down := "http://127.0.0.1:1/sdk"
+	config := govmomitest.GetSimulatorConfig(true)
+	delete(config, "url")
+	config["urls"] = []string{down, govmomitest.SimulatorURL}
+	testConfigCreate(t, b, s, config)
+	b.reset()
+
+	// the first URL that succeeds is the active one
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config",
+		Data:      map[string]interface{}{"verify": true},
+		Storage:   s,
+	})
+	nilErr(t, err)
+	equal(t, down, resp.Data["url"])
+	equal(t, []string{down, govmomitest.SimulatorURL}, resp.Data["urls"])
+	equal(t, govmomitest.SimulatorURLWithoutUserinfo(), resp.Data["active_url"])
+	equal(t, govmomitest.SimulatorURL, b.connection(defaultConnectionName).activeURL)
+
+	// the credentials carry the URL they are valid against
+	testRoleCreate(t, b, s, "test_role", testStaticSPRole)
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "session/test_role",
+		Storage:   s,
+	})
+	nilErr(t, err)
+	equal(t, govmomitest.SimulatorURLWithoutUserinfo(), resp.Data["url"])
+
+	// the config is rejected when no URL succeeds
+	resp, _ = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "config",
+		Data: map[string]interface{}{
+			"urls": []string{down, "http://127.0.0.1:2/sdk"},
+		},
+		Storage: s,
+	})
+	if !resp.IsError() {
+		t.Fatal("expected a response error")
+	}
+	if !strings.Contains(resp.Error().Error(), down) || !strings.Contains(resp.Error().Error(), "127.0.0.1:2") {
+		t.Fatalf("expected the error to name each URL: %s", resp.Error())
+	}
+}
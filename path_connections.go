@@ -0,0 +1,149 @@
+package vspheresecrets
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	connectionsStoragePath = "config/connections/"
+
+	// defaultConnectionName is the name of the connection configured at "config".
+	defaultConnectionName = ""
+)
+
+// connectionStoragePath returns the storage path of the config of the named connection.
+func connectionStoragePath(name string) string {
+	if name == defaultConnectionName {
+		return configStoragePath
+	}
+	return connectionsStoragePath + name
+}
+
+func pathsConnection(b *vsphereSecretBackend) []*framework.Path {
+	fields := configFields()
+	fields["name"] = &framework.FieldSchema{
+		Type:        framework.TypeLowerCaseString,
+		Description: "Name of the connection.",
+	}
+
+	return []*framework.Path{
+		{
+			Pattern: "config/connections/" + framework.GenericNameRegex("name"),
+			Fields:  fields,
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathConnectionRead,
+				logical.CreateOperation: b.pathConnectionWrite,
+				logical.UpdateOperation: b.pathConnectionWrite,
+				logical.DeleteOperation: b.pathConnectionDelete,
+			},
+			ExistenceCheck:  b.pathConnectionExistenceCheck,
+			HelpSynopsis:    connectionHelpSyn,
+			HelpDescription: connectionHelpDesc,
+		},
+		{
+			Pattern: "config/connections/?",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathConnectionList,
+			},
+			HelpSynopsis:    connectionListHelpSyn,
+			HelpDescription: connectionListHelpDesc,
+		},
+	}
+}
+
+func (b *vsphereSecretBackend) pathConnectionWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return b.writeConnectionConfig(ctx, req, d, d.Get("name").(string))
+}
+
+func (b *vsphereSecretBackend) pathConnectionRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	config, err := b.getConnectionConfig(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		return nil, nil
+	}
+
+	return b.connectionConfigResponse(ctx, req.Storage, name, config, d.Get("verify").(bool)), nil
+}
+
+// pathConnectionDelete deletes a named connection unless it is still referenced by a role, or by the
+// dynamic users, sessions and pending rollbacks of live leases: their revocation needs the connection.
+func (b *vsphereSecretBackend) pathConnectionDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	roles, err := req.Storage.List(ctx, rolesStoragePath+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing roles: {{err}}", err)
+	}
+	for _, roleName := range roles {
+		role, err := getRole(ctx, roleName, req.Storage)
+		if err != nil {
+			return nil, errwrap.Wrapf("error reading role: {{err}}", err)
+		}
+		if role != nil && role.Connection == name {
+			return logical.ErrorResponse(fmt.Sprintf("connection '%s' is used by role '%s'", name, roleName)), nil
+		}
+	}
+
+	live, err := liveUsernames(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(live) != 0 {
+		return logical.ErrorResponse(fmt.Sprintf("connection '%s' is used by %d dynamic users of live leases or pending rollbacks", name, len(live))), nil
+	}
+
+	sessions, err := listSessions(ctx, req.Storage)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing sessions: {{err}}", err)
+	}
+	for _, session := range sessions {
+		if session.Connection == name {
+			return logical.ErrorResponse(fmt.Sprintf("connection '%s' is used by a live session of role '%s'", name, session.Role)), nil
+		}
+	}
+
+	if err := req.Storage.Delete(ctx, connectionStoragePath(name)); err != nil {
+		return nil, err
+	}
+	b.resetConnection(name)
+
+	return nil, nil
+}
+
+func (b *vsphereSecretBackend) pathConnectionExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	config, err := b.getConnectionConfig(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return false, err
+	}
+
+	return config != nil, nil
+}
+
+func (b *vsphereSecretBackend) pathConnectionList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	connections, err := req.Storage.List(ctx, connectionsStoragePath)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing connections: {{err}}", err)
+	}
+
+	return logical.ListResponse(connections), nil
+}
+
+const connectionHelpSyn = `Configure a named vCenter connection.`
+const connectionHelpDesc = `
+A mount can manage several vCenters. Each named connection accepts the same
+fields as the "config" endpoint, which configures the default connection.
+The GOVMOMI_* environment variables only apply to the default connection.
+
+Roles reference a named connection with their "connection" field.
+`
+const connectionListHelpSyn = `List the named vCenter connections.`
+const connectionListHelpDesc = `List the named vCenter connections.`
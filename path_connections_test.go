@@ -0,0 +1,145 @@
+package vspheresecrets
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+)
+
+func TestConnections(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	ctx := context.Background()
+
+	config := govmomitest.GetSimulatorConfig(true)
+	testRequest(t, b, s, logical.CreateOperation, "config/connections/dc1", config)
+
+	resp := testRequest(t, b, s, logical.ReadOperation, "config/connections/dc1", nil)
+	equal(t, config["url"], resp.Data["url"])
+	if _, ok := resp.Data["password"]; ok {
+		t.Fatal("the password must not be returned")
+	}
+
+	resp = testRequest(t, b, s, logical.ListOperation, "config/connections/", nil)
+	equal(t, []string{"dc1"}, resp.Data["keys"])
+
+	t.Run("Client", func(t *testing.T) {
+		client, err := b.getConnectionClient(ctx, s, "dc1")
+		nilErr(t, err)
+		testListDatacenters(t, client.provider.GetMountGovmomiClient())
+
+		cached, err := b.getConnectionClient(ctx, s, "dc1")
+		nilErr(t, err)
+		if cached != client {
+			t.Fatal("expected the client of the connection to be cached")
+		}
+
+		// invalidation is keyed by the storage path of the connection
+		b.invalidate(ctx, "config")
+		cached, err = b.getConnectionClient(ctx, s, "dc1")
+		nilErr(t, err)
+		if cached != client {
+			t.Fatal("expected the client of the connection to be retained")
+		}
+		b.invalidate(ctx, "config/connections/dc1")
+		cached, err = b.getConnectionClient(ctx, s, "dc1")
+		nilErr(t, err)
+		if cached == client {
+			t.Fatal("expected the client of the connection to be recreated")
+		}
+
+		if _, err := b.getConnectionClient(ctx, s, "unknown"); err == nil {
+			t.Fatal("expected an error for an unknown connection")
+		}
+	})
+
+	t.Run("Roles", func(t *testing.T) {
+		testRoleCreate(t, b, s, "dc1-role", map[string]interface{}{
+			"vsphere_roles": "Admin",
+			"connection":    "dc1",
+		})
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "roles/unknown-role",
+			Data: map[string]interface{}{
+				"vsphere_roles": "Admin",
+				"connection":    "unknown",
+			},
+			Storage: s,
+		})
+		nilErr(t, err)
+		if !resp.IsError() {
+			t.Fatal("expected an error for a role with an unknown connection")
+		}
+
+		// the connection cannot be deleted while a role references it
+		resp, err = b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "config/connections/dc1",
+			Storage:   s,
+		})
+		nilErr(t, err)
+		if !resp.IsError() {
+			t.Fatal("expected an error when deleting a connection in use")
+		}
+
+		testRequest(t, b, s, logical.DeleteOperation, "roles/dc1-role", nil)
+
+		// nor while the leases of a previous role need it to be revoked
+		testConnectionDeleteError := func() {
+			t.Helper()
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.DeleteOperation,
+				Path:      "config/connections/dc1",
+				Storage:   s,
+			})
+			nilErr(t, err)
+			if !resp.IsError() {
+				t.Fatal("expected an error when deleting a connection with live leases")
+			}
+		}
+		user := &dynamicUser{Role: "dc1-role", Connection: "dc1", Username: "dc1-role-abc"}
+		nilErr(t, savePrincipal(ctx, s, user))
+		testConnectionDeleteError()
+		nilErr(t, deletePrincipal(ctx, s, user))
+
+		walID, err := framework.PutWAL(ctx, s, walUserKind, &walUser{dynamicUser: *user, Expiration: time.Now().Add(maxWALAge)})
+		nilErr(t, err)
+		testConnectionDeleteError()
+		nilErr(t, framework.DeleteWAL(ctx, s, walID))
+
+		session := &sessionEntry{ID: "id", Role: "dc1-role", Connection: "dc1"}
+		nilErr(t, saveSession(ctx, s, session))
+		testConnectionDeleteError()
+		nilErr(t, deleteSession(ctx, s, session.Role, session.ID))
+
+		testRequest(t, b, s, logical.DeleteOperation, "config/connections/dc1", nil)
+
+		resp = testRequest(t, b, s, logical.ReadOperation, "config/connections/dc1", nil)
+		if resp != nil {
+			t.Fatal("expected the connection to be deleted")
+		}
+	})
+}
+
+func testRequest(t *testing.T, b *vsphereSecretBackend, s logical.Storage, op logical.Operation, path string, d map[string]interface{}) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      path,
+		Data:      d,
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if resp != nil && resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+	return resp
+}
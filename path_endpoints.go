@@ -0,0 +1,65 @@
+package vspheresecrets
+
+import (
+	"context"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathEndpoints(b *vsphereSecretBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/endpoints",
+		Fields: map[string]*framework.FieldSchema{
+			"connection": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the connection. When empty, the default connection is used.",
+				Query:       true,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathEndpointsRead,
+		},
+		HelpSynopsis:    endpointsHelpSyn,
+		HelpDescription: endpointsHelpDesc,
+	}
+}
+
+// pathEndpointsRead lists the vCenters registered with the lookup service of the SSO domain.
+func (b *vsphereSecretBackend) pathEndpointsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	client, err := b.getConnectionClient(ctx, req.Storage, d.Get("connection").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints, err := client.vcenterEndpoints(ctx)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing the vCenter endpoints: {{err}}", err)
+	}
+
+	data := make([]map[string]interface{}, len(endpoints))
+	for i, e := range endpoints {
+		data[i] = map[string]interface{}{
+			"url":           e.URL,
+			"instance_name": e.InstanceName,
+			"instance_uuid": e.InstanceUUID,
+			"site_id":       e.SiteID,
+			"node_id":       e.NodeID,
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"endpoints": data,
+		},
+	}, nil
+}
+
+const endpointsHelpSyn = `List the vCenters of the SSO domain.`
+const endpointsHelpDesc = `
+With Enhanced Linked Mode, a single SSO domain backs several vCenters.
+This endpoint lists the vCenters registered with the lookup service of the
+SSO domain of a connection. The credentials issued by the backend include
+the URLs of those vCenters.
+`
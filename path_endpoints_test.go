@@ -0,0 +1,38 @@
+package vspheresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+)
+
+func TestEndpoints(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, true)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config/endpoints",
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+
+	endpoints := resp.Data["endpoints"].([]map[string]interface{})
+	if len(endpoints) != 1 {
+		t.Fatalf("expected the simulator to register a single vCenter, got %d", len(endpoints))
+	}
+	if !strings.HasPrefix(endpoints[0]["url"].(string), govmomitest.SimulatorURLWithoutUserinfo()) {
+		t.Fatalf("expected the simulator to be registered, got %s", endpoints[0]["url"])
+	}
+	if endpoints[0]["instance_uuid"] == "" {
+		t.Fatal("expected the instance uuid of the vCenter")
+	}
+}
@@ -0,0 +1,101 @@
+package vspheresecrets
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/vmware/govmomi/find"
+)
+
+// inventoryContainers are the types of the inventory objects that have children to list.
+var inventoryContainers = map[string]bool{
+	"Folder":                 true,
+	"StoragePod":             true,
+	"Datacenter":             true,
+	"ComputeResource":        true,
+	"ClusterComputeResource": true,
+	"ResourcePool":           true,
+	"VirtualApp":             true,
+	"HostSystem":             true,
+}
+
+func pathInventory(b *vsphereSecretBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "inventory/?" + framework.MatchAllRegex("path"),
+		Fields: map[string]*framework.FieldSchema{
+			"path": {
+				Type:        framework.TypeString,
+				Description: "Inventory path of the object to list the children of, such as dc0/vm. When empty, the children of the root folder are listed.",
+			},
+			"connection": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the connection. When empty, the default connection is used.",
+				Query:       true,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathInventoryList,
+		},
+		HelpSynopsis:    inventoryHelpSyn,
+		HelpDescription: inventoryHelpDesc,
+	}
+}
+
+// pathInventoryList lists the children of an inventory object with their type, reference and inventory path.
+// The names of the objects that have children end with a slash, so that they can be listed in turn.
+func (b *vsphereSecretBackend) pathInventoryList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	inventoryPath := normalizeInventoryPath(d.Get("path").(string))
+
+	client, err := b.getConnectionClient(ctx, req.Storage, d.Get("connection").(string))
+	if err != nil {
+		return nil, err
+	}
+
+	finder := find.NewFinder(client.provider.GetMountGovmomiClient().Client)
+	objects, err := finder.ManagedObjectList(ctx, inventoryPath)
+	if err != nil {
+		return nil, errwrap.Wrapf("error looking up the inventory path: {{err}}", err)
+	}
+	if len(objects) == 0 {
+		return logical.ErrorResponse(fmt.Sprintf("inventory path '%s' does not exist", inventoryPath)), nil
+	}
+	elements, err := finder.ManagedObjectListChildren(ctx, inventoryPath)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing the inventory: {{err}}", err)
+	}
+
+	keys := make([]string, 0, len(elements))
+	keyInfo := make(map[string]interface{}, len(elements))
+	for _, e := range elements {
+		ref := e.Object.Reference()
+		key := path.Base(e.Path)
+		if inventoryContainers[ref.Type] {
+			key += "/"
+		}
+		keys = append(keys, key)
+		keyInfo[key] = map[string]interface{}{
+			"type":  ref.Type,
+			"moref": ref.String(),
+			"path":  e.Path,
+		}
+	}
+	sort.Strings(keys)
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+const inventoryHelpSyn = `Browse the vSphere inventory.`
+const inventoryHelpDesc = `
+This endpoint lists the children of an inventory object of the vCenter of a connection,
+with their type, managed object reference and full inventory path. The inventory paths
+are the values accepted by the folders of the vsphere_roles of a role.
+
+The names of the objects that have children end with a slash. For example:
+
+    $ vault list vsphere/inventory
+    $ vault list vsphere/inventory/dc0/vm
+`
@@ -0,0 +1,48 @@
+package vspheresecrets
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+)
+
+func TestInventory(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, true)
+
+	resp := testRequest(t, b, s, logical.ListOperation, "inventory/", nil)
+	equal(t, []string{"DC0/"}, resp.Data["keys"])
+	equal(t, map[string]interface{}{
+		"type":  "Datacenter",
+		"moref": "Datacenter:datacenter-2",
+		"path":  "/DC0",
+	}, resp.Data["key_info"].(map[string]interface{})["DC0/"])
+
+	resp = testRequest(t, b, s, logical.ListOperation, "inventory/DC0/", nil)
+	equal(t, []string{"datastore/", "host/", "network/", "vm/"}, resp.Data["keys"])
+
+	// the listed paths are accepted by the folders of the vSphere roles
+	resp = testRequest(t, b, s, logical.ListOperation, "inventory/DC0/vm", nil)
+	keyInfo := resp.Data["key_info"].(map[string]interface{})
+	for _, key := range resp.Data["keys"].([]string) {
+		info := keyInfo[key].(map[string]interface{})
+		equal(t, "VirtualMachine", info["type"])
+		testRoleCreate(t, b, s, "vm", map[string]interface{}{
+			"vsphere_roles": `[{"role_name":"ReadOnly","folders":["` + info["path"].(string) + `"]}]`,
+		})
+	}
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "inventory/DC0/missing/",
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if !resp.IsError() {
+		t.Fatal("expected a response error")
+	}
+}
@@ -1,13 +1,20 @@
 package vspheresecrets
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -17,16 +24,135 @@ const (
 	credentialTypeSP = 0
 )
 
+// roleSchemaVersion is the version of the stored roles. The roles stored by the previous
+// versions are upgraded on read, and in storage when the mount is initialized.
+// The version 1 stored vsphere_roles as role names and the password in plain text. The version 2
+// stores vsphere_roles as vsphereRole objects and the password encrypted with the role key.
+const roleSchemaVersion = 2
+
 // roleEntry is a Vault role construct that maps to vSphere roles or Applications
 type roleEntry struct {
-	// CredentialType      int           `json:"credential_type"` // Reserved. Always SP at this time.
-	Username string `json:"username"`
-	Password string `json:"password"` // make sure we dont serialize it back though
-	// ApplicationObjectID string        `json:"application_object_id"`
-	TTL           time.Duration `json:"ttl"`
-	VSphereRoles  []string      `json:"vsphere_roles"`
-	VSphereGroups []string      `json:"vsphere_groups"`
-	MaxTTL        time.Duration `json:"max_ttl"`
+	// SchemaVersion is the version of the schema the role was stored with. It is 0 for the roles of version 1.
+	SchemaVersion int    `json:"schema_version,omitempty"`
+	Username      string `json:"username"`
+	Password      string `json:"password,omitempty"` // only stored in plain text by the older versions
+	// EncryptedPassword is the password encrypted with the role key of the mount.
+	EncryptedPassword string         `json:"encrypted_password,omitempty"`
+	TTL               time.Duration  `json:"ttl"`
+	VSphereRoles      []*vsphereRole `json:"vsphere_roles"`
+	VSphereGroups     []string       `json:"vsphere_groups"`
+	MaxTTL            time.Duration  `json:"max_ttl"`
+	Connection        string         `json:"connection,omitempty"`
+	SSOToken          bool           `json:"sso_token,omitempty"`
+	// Privileges are granted on the root folder through PrivilegeRole, a vSphere role owned by the role.
+	Privileges    []string `json:"privileges,omitempty"`
+	PrivilegeRole string   `json:"privilege_role,omitempty"`
+	// UsernameCharset is the charset of the random characters of the usernames. It defaults to defaultUsernameCharset.
+	UsernameCharset string `json:"username_charset,omitempty"`
+	// AllowedTargets are the inventory path patterns of the targets a credentials request can grant the role on.
+	AllowedTargets []string `json:"allowed_targets,omitempty"`
+}
+
+// vsphereRole is a vSphere role granted to the dynamic users on inventory objects.
+type vsphereRole struct {
+	RoleName string `json:"role_name"`
+	// Folders are the inventory paths of the objects the role is granted on, such as dc0/vm/tenant1.
+	// The role is granted on the root folder when both the folders and the tags are empty.
+	Folders []string `json:"folders,omitempty"`
+	// Tags select the objects the role is granted on when the credentials are issued.
+	Tags []*vsphereTag `json:"tags,omitempty"`
+}
+
+// vsphereTag is a vSphere tag, by the names of its category and of the tag.
+type vsphereTag struct {
+	Category string `json:"category"`
+	Tag      string `json:"tag"`
+}
+
+// String returns the tag as category:tag.
+func (t *vsphereTag) String() string {
+	return t.Category + ":" + t.Tag
+}
+
+// UnmarshalJSON decodes a vSphere role from an object, or from the name of the role as stored by the version 1 of the schema.
+func (r *vsphereRole) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*r = vsphereRole{RoleName: name}
+		return nil
+	}
+	type plain vsphereRole
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// roleBinding grants a vSphere role on the object at an inventory path, or on the objects with a tag.
+// The bindings of a tag are resolved to the bindings of the tagged objects, with their Entity.
+type roleBinding struct {
+	Role   string
+	Path   string
+	Tag    *vsphereTag
+	Entity string
+}
+
+// bindings returns the vSphere roles granted to the dynamic users of a role, with the inventory paths
+// and the tags they are granted on. The role created for the privileges is granted on the root folder.
+func (r *roleEntry) bindings() []roleBinding {
+	var bindings []roleBinding
+	if r.PrivilegeRole != "" {
+		bindings = append(bindings, roleBinding{Role: r.PrivilegeRole, Path: "/"})
+	}
+	for _, vr := range r.VSphereRoles {
+		for _, path := range vr.entityPaths() {
+			bindings = append(bindings, roleBinding{Role: vr.RoleName, Path: path})
+		}
+		for _, tag := range vr.Tags {
+			bindings = append(bindings, roleBinding{Role: vr.RoleName, Tag: tag})
+		}
+	}
+	return bindings
+}
+
+// targetBindings returns the bindings of a role with allowed_targets, granted on the target of a credentials request.
+func (r *roleEntry) targetBindings(target string) []roleBinding {
+	bindings := r.bindings()
+	for i := range bindings {
+		bindings[i].Path = target
+	}
+	return bindings
+}
+
+// allowsTarget returns true when a normalized inventory path matches one of the allowed_targets of a role.
+func (r *roleEntry) allowsTarget(target string) bool {
+	for _, pattern := range r.AllowedTargets {
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// entityPaths returns the inventory paths the role is granted on.
+func (r *vsphereRole) entityPaths() []string {
+	if len(r.Folders) == 0 && len(r.Tags) == 0 {
+		return []string{"/"}
+	}
+	return r.Folders
+}
+
+// validateEntityRoles returns an error when a role grants several vSphere roles on the same entity.
+// A principal has a single role on an entity: the permission of each vSphere role would replace the previous one.
+func (r *roleEntry) validateEntityRoles() error {
+	entities := make(map[string]bool)
+	for _, vr := range r.VSphereRoles {
+		for _, path := range vr.entityPaths() {
+			path = normalizeInventoryPath(path)
+			if entities[path] {
+				return fmt.Errorf("a single vSphere role can be granted on '%s'", path)
+			}
+			entities[path] = true
+		}
+	}
+	return nil
 }
 
 func pathsRole(b *vsphereSecretBackend) []*framework.Path {
@@ -40,15 +166,27 @@ func pathsRole(b *vsphereSecretBackend) []*framework.Path {
 				},
 				"username": {
 					Type:        framework.TypeString,
-					Description: "Optional username to use. Or existing username (when password is defined). Each '?' character is replaced by a random a-z0-9 character for each call. When empty, the default value is vault-{role}-???",
+					Description: "Optional username to use. Or existing username (when password is defined). Each '?' character is replaced by a random character of the username_charset for each call, and a username that is already taken is generated again. A username template is at most 31 characters long, with letters, digits, '-', '_', '.' and at least 3 '?'. Identity templates such as {{identity.entity.name}} are replaced with the values of the entity of the request. When empty, the default value is {role}-???",
+				},
+				"username_charset": {
+					Type:        framework.TypeString,
+					Description: "Characters the '?' characters of the username are replaced with. Letters, digits, '-', '_' and '.' are accepted. Defaults to a-z0-9.",
 				},
 				"password": {
 					Type:        framework.TypeString,
 					Description: "Optional password to use. When defined, no users are created.",
 				},
 				"vsphere_roles": {
+					Type:        framework.TypeSlice,
+					Description: `vSphere roles to grant to the dynamic users - when password is empty. Either a comma separated list of role names granted on the root folder, or a JSON list of objects with a role_name, the inventory paths of the folders to grant it on and the tags of the objects to grant it on. For example: [{"role_name":"VirtualMachineUser","folders":["dc0/vm/tenant1"],"tags":[{"category":"tenant","tag":"tenant1"}]}]`,
+				},
+				"privileges": {
 					Type:        framework.TypeCommaStringSlice,
-					Description: "Comma separated list of vSphere roles to assign - when password is empty.",
+					Description: "Comma separated list of vSphere privilege identifiers to grant to the dynamic users on the root folder instead of vsphere_roles, such as VirtualMachine.Interact.PowerOn. A vSphere role named after the Vault role is created with them.",
+				},
+				"allowed_targets": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Comma separated list of inventory path patterns, such as /dc0/vm/tenant1/*. When defined, each credentials request passes the target to grant the vSphere role or the privileges of the role on, and the role grants them on that target only. A '*' matches any sequence of characters except '/'.",
 				},
 				"vsphere_groups": {
 					Type:        framework.TypeCommaStringSlice,
@@ -62,6 +200,19 @@ func pathsRole(b *vsphereSecretBackend) []*framework.Path {
 					Type:        framework.TypeDurationSecond,
 					Description: "Maximum time a service principal. If not set or set to 0, will use system default.",
 				},
+				"sso_token": {
+					Type:        framework.TypeBool,
+					Description: "When true, the credentials include a SAML bearer token issued by the SSO domain. The token is valid on all the vCenters linked to the SSO domain.",
+				},
+				"connection": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the vCenter connection configured at config/connections/<name>. When empty, the default connection configured at config is used.",
+				},
+				"force": {
+					Type:        framework.TypeBool,
+					Description: "On delete, revoke the users and sessions of the active leases of the role. A role with active leases can not be deleted otherwise.",
+					Query:       true,
+				},
 			},
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.ReadOperation:   b.pathRoleRead,
@@ -96,13 +247,14 @@ func pathsRole(b *vsphereSecretBackend) []*framework.Path {
 //   Given just role name, a search will be performed and if exactly one match is found,
 //   that role will be used.
 
-//   vSphere groups are checked for existence. The vSphere groups lookup step will allow the
-//   operator to provide a groups name or ID. ID is unambigious and will be used if provided.
-//   Given just group name, a search will be performed and if exactly one match is found,
-//   that group will be used.
+//	vSphere groups are checked for existence. The vSphere groups lookup step will allow the
+//	operator to provide a groups name or ID. ID is unambigious and will be used if provided.
+//	Given just group name, a search will be performed and if exactly one match is found,
+//	that group will be used.
 //
 // Static Service Principal:
-//   The provided Application Object ID is checked for existence.
+//
+//	The provided Application Object ID is checked for existence.
 func (b *vsphereSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	var resp *logical.Response
 
@@ -113,6 +265,11 @@ func (b *vsphereSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.
 
 	// load or create role
 	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
 	role, err := getRole(ctx, name, req.Storage)
 	if err != nil {
 		return nil, errwrap.Wrapf("error reading role: {{err}}", err)
@@ -142,13 +299,27 @@ func (b *vsphereSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.
 		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
 	}
 
+	// the stored username templates of the dynamic roles are not validated again: the roles written
+	// before the minimum number of random characters was introduced keep working
+	var previousUsername string
+	if role.Password == "" {
+		previousUsername = role.Username
+	}
+
 	// update and verify Application Object ID if provided
 	if username, ok := d.GetOk("username"); ok {
 		role.Username = username.(string)
 	}
 
+	if password, ok := d.GetOk("password"); ok {
+		role.Password = password.(string)
+	}
+
+	if ssoToken, ok := d.GetOk("sso_token"); ok {
+		role.SSOToken = ssoToken.(bool)
+	}
+
 	if role.Username != "" && role.Password != "" {
-		fmt.Println("Username and password pre-set")
 		// TODO: check for the user to be defined already
 		// app, err := client.provider.GetApplication(ctx, role.Username)
 		// if err != nil {
@@ -156,12 +327,47 @@ func (b *vsphereSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.
 		// }
 		// role.ApplicationID = to.String(app.AppID)
 	} else if role.Username == "" {
-		role.Username = name + "-???"
+		role.Username = defaultUsernameTemplate(name)
+	}
+
+	if charset, ok := d.GetOk("username_charset"); ok {
+		role.UsernameCharset = charset.(string)
+	}
+
+	if connection, ok := d.GetOk("connection"); ok {
+		role.Connection = connection.(string)
+		if role.Connection != defaultConnectionName {
+			config, err := b.getConnectionConfig(ctx, req.Storage, role.Connection)
+			if err != nil {
+				return nil, err
+			}
+			if config == nil {
+				return logical.ErrorResponse(fmt.Sprintf("connection '%s' does not exist", role.Connection)), nil
+			}
+		}
 	}
 
 	// Parse the VSPhere roles
 	if roles, ok := d.GetOk("vsphere_roles"); ok {
-		role.VSphereRoles = roles.([]string)
+		role.VSphereRoles, err = parseVSphereRoles(roles.([]interface{}))
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid vsphere_roles: %s", err)), nil
+		}
+	}
+
+	if privileges, ok := d.GetOk("privileges"); ok {
+		role.Privileges = privileges.([]string)
+	}
+
+	if allowedTargets, ok := d.GetOk("allowed_targets"); ok {
+		role.AllowedTargets = nil
+		for _, pattern := range allowedTargets.([]string) {
+			pattern = normalizeInventoryPath(pattern)
+			if _, err := path.Match(pattern, ""); err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("invalid allowed_targets pattern '%s': %s", pattern, err)), nil
+			}
+			role.AllowedTargets = strutil.AppendIfMissing(role.AllowedTargets, pattern)
+		}
 	}
 
 	// Parse the Azure groups
@@ -243,16 +449,112 @@ func (b *vsphereSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.
 	// 	groupSet[r.ObjectID] = true
 	// }
 
-	if role.Password == "" && len(role.VSphereRoles) == 0 && len(role.VSphereGroups) == 0 {
-		return logical.ErrorResponse("either vSphere role definitions, group definitions, or a username and password must be provided"), nil
+	if role.Password == "" && len(role.VSphereRoles) == 0 && len(role.VSphereGroups) == 0 && len(role.Privileges) == 0 {
+		return logical.ErrorResponse("either vSphere role definitions, group definitions, privileges, or a username and password must be provided"), nil
+	}
+
+	if len(role.Privileges) != 0 {
+		if role.Password != "" {
+			return logical.ErrorResponse("privileges can only be granted to dynamic users"), nil
+		}
+		if len(role.VSphereRoles) != 0 {
+			return logical.ErrorResponse("privileges and vsphere_roles are mutually exclusive"), nil
+		}
+	}
+
+	if len(role.AllowedTargets) != 0 {
+		if role.Password != "" {
+			return logical.ErrorResponse("allowed_targets can only be used by dynamic users"), nil
+		}
+		if len(role.VSphereRoles)+len(role.Privileges) == 0 || len(role.VSphereRoles) > 1 ||
+			(len(role.VSphereRoles) == 1 && (len(role.VSphereRoles[0].Folders) != 0 || len(role.VSphereRoles[0].Tags) != 0)) {
+			return logical.ErrorResponse("allowed_targets require privileges or a single vSphere role, without folders or tags"), nil
+		}
+	}
+
+	if role.Password == "" {
+		if role.Username != previousUsername {
+			if err := validateUsernameTemplate(role.Username); err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("invalid username: %s", err)), nil
+			}
+			if err := validateUsernameRandomChars(role.Username); err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("invalid username: %s", err)), nil
+			}
+		}
+		if role.UsernameCharset != "" {
+			if err := validateUsernameCharset(role.UsernameCharset); err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
+	}
+
+	if role.hasIdentityTemplates() && role.Password != "" {
+		return logical.ErrorResponse("identity templates can only be used by dynamic users"), nil
+	}
+	if err := role.validateIdentityTemplates(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if err := role.validateEntityRoles(); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	previousRole, previousConnection := role.PrivilegeRole, role.Connection
+	role.PrivilegeRole = ""
+	if len(role.Privileges) != 0 {
+		role.PrivilegeRole, err = b.privilegeRoleName(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the targets and the templated paths are only checked against the allowed paths when the credentials are requested
+	bindings := role.bindings()
+	if len(role.AllowedTargets) != 0 {
+		bindings = role.targetBindings("")
+	}
+	for i := range bindings {
+		if hasIdentityTemplate(bindings[i].Path) {
+			bindings[i].Path = ""
+		}
+	}
+	violations, err := b.roleGuardrailViolations(ctx, req.Storage, role.Connection, bindings, role.VSphereGroups, map[string][]string{role.PrivilegeRole: role.Privileges})
+	if err != nil {
+		return nil, err
+	}
+	if len(violations) != 0 {
+		return logical.ErrorResponse(fmt.Sprintf("the role violates the guardrails of the mount: %s", strings.Join(violations, "; "))), nil
+	}
+
+	// create or update the vSphere role of the privileges
+	if len(role.Privileges) != 0 {
+		client, err := b.getConnectionClient(ctx, req.Storage, role.Connection)
+		if err != nil {
+			return nil, err
+		}
+		unknown, err := client.savePrivilegeRole(ctx, role.PrivilegeRole, role.Privileges)
+		if err != nil {
+			return nil, err
+		}
+		if len(unknown) != 0 {
+			return logical.ErrorResponse(fmt.Sprintf("unknown privileges: %s", strings.Join(unknown, ", "))), nil
+		}
 	}
 
 	// save role
-	err = saveRole(ctx, req.Storage, role, name)
+	err = b.saveRole(ctx, req.Storage, role, name)
 	if err != nil {
 		return nil, errwrap.Wrapf("error storing role: {{err}}", err)
 	}
 
+	// the vSphere role of the privileges is no longer used by the role
+	if previousRole != "" && (previousRole != role.PrivilegeRole || previousConnection != role.Connection) {
+		if warning := b.deletePrivilegeRole(ctx, req.Storage, previousConnection, previousRole); warning != "" {
+			resp = &logical.Response{}
+			resp.AddWarning(warning)
+		}
+	}
+
 	return resp, nil
 }
 
@@ -275,7 +577,13 @@ func (b *vsphereSecretBackend) pathRoleRead(ctx context.Context, req *logical.Re
 	data["vsphere_roles"] = r.VSphereRoles
 	data["vsphere_groups"] = r.VSphereGroups
 	data["username"] = r.Username
-	data["password"] = r.Password
+	data["username_charset"] = r.UsernameCharset
+	data["password_set"] = r.Password != ""
+	data["connection"] = r.Connection
+	data["sso_token"] = r.SSOToken
+	data["privileges"] = r.Privileges
+	data["privilege_role"] = r.PrivilegeRole
+	data["allowed_targets"] = r.AllowedTargets
 
 	return &logical.Response{
 		Data: data,
@@ -291,17 +599,110 @@ func (b *vsphereSecretBackend) pathRoleList(ctx context.Context, req *logical.Re
 	return logical.ListResponse(roles), nil
 }
 
+// pathRoleDelete deletes a role unless it has active leases. With force, the dynamic users of the leases
+// are deleted and their sessions logged out first. The leases expire with their credentials revoked.
 func (b *vsphereSecretBackend) pathRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	name := d.Get("name").(string)
+	force := d.Get("force").(bool)
+
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
 
-	err := req.Storage.Delete(ctx, fmt.Sprintf("%s/%s", rolesStoragePath, name))
+	principals, err := listRolePrincipals(ctx, req.Storage, name)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing the principals of the role: {{err}}", err)
+	}
+	sessions, err := listRoleSessions(ctx, req.Storage, name)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing the sessions of the role: {{err}}", err)
+	}
+
+	if leases := len(principals) + len(sessions); leases != 0 {
+		if !force {
+			return logical.ErrorResponse(fmt.Sprintf("role '%s' has %d active leases: delete it with force=true to revoke them", name, leases)), nil
+		}
+		if err := b.revokeRoleLeases(ctx, req.Storage, principals, sessions); err != nil {
+			return nil, errwrap.Wrapf("error revoking the leases of the role: {{err}}", err)
+		}
+	}
+
+	role, err := getRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading role: {{err}}", err)
+	}
+
+	err = req.Storage.Delete(ctx, fmt.Sprintf("%s/%s", rolesStoragePath, name))
 	if err != nil {
 		return nil, errwrap.Wrapf("error deleting role: {{err}}", err)
 	}
 
+	if role != nil && role.PrivilegeRole != "" {
+		if warning := b.deletePrivilegeRole(ctx, req.Storage, role.Connection, role.PrivilegeRole); warning != "" {
+			resp := &logical.Response{}
+			resp.AddWarning(warning)
+			return resp, nil
+		}
+	}
+
 	return nil, nil
 }
 
+// privilegeRoleName returns the name of the vSphere role created for the privileges of a role.
+// It identifies the mount, so that the roles of the same name in different mounts do not share it.
+func (b *vsphereSecretBackend) privilegeRoleName(ctx context.Context, s logical.Storage, name string) (string, error) {
+	mountID, err := b.mountID(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("vault-%s-%s", name, mountID[:8]), nil
+}
+
+// deletePrivilegeRole deletes the vSphere role of the privileges of a role once no permission grants it.
+// The role is kept when it can not be deleted: the returned warning explains why.
+func (b *vsphereSecretBackend) deletePrivilegeRole(ctx context.Context, s logical.Storage, connection, vsphereRole string) string {
+	c, err := b.getConnectionClient(ctx, s, connection)
+	if err != nil {
+		return fmt.Sprintf("the vSphere role '%s' was not deleted: %s", vsphereRole, err)
+	}
+	deleted, err := c.provider.DeleteRoleIfUnused(ctx, vsphereRole)
+	if err != nil {
+		return fmt.Sprintf("the vSphere role '%s' was not deleted: %s", vsphereRole, err)
+	}
+	if !deleted {
+		return fmt.Sprintf("the vSphere role '%s' was not deleted: it is still granted by some permissions", vsphereRole)
+	}
+	return ""
+}
+
+// revokeRoleLeases deletes the dynamic users and logs out the sessions of the leases of a role.
+// The users and sessions that are revoked are removed from the index, so that a failed deletion can be retried.
+func (b *vsphereSecretBackend) revokeRoleLeases(ctx context.Context, s logical.Storage, principals []*principalEntry, sessions []*sessionEntry) error {
+	var merr *multierror.Error
+	for _, p := range principals {
+		c, err := b.getConnectionClient(ctx, s, p.Connection)
+		if err == nil {
+			err = c.deleteUser(ctx, &p.dynamicUser)
+		}
+		if err == nil {
+			err = deletePrincipal(ctx, s, &p.dynamicUser)
+		}
+		if err != nil {
+			merr = multierror.Append(merr, errwrap.Wrapf(fmt.Sprintf("error deleting user '%s': {{err}}", p.Username), err))
+		}
+	}
+	for _, session := range sessions {
+		err := logoutSession(ctx, session.GovmomiClient)
+		if err == nil {
+			err = deleteSession(ctx, s, session.Role, session.ID)
+		}
+		if err != nil {
+			merr = multierror.Append(merr, errwrap.Wrapf(fmt.Sprintf("error logging out session '%s': {{err}}", session.ID), err))
+		}
+	}
+	return merr.ErrorOrNil()
+}
+
 func (b *vsphereSecretBackend) pathRoleExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
 	name := d.Get("name").(string)
 
@@ -313,8 +714,116 @@ func (b *vsphereSecretBackend) pathRoleExistenceCheck(ctx context.Context, req *
 	return role != nil, nil
 }
 
-func saveRole(ctx context.Context, s logical.Storage, c *roleEntry, name string) error {
-	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", rolesStoragePath, name), c)
+// parseVSphereRoles parses the vsphere_roles field: role names, comma separated lists of
+// role names, objects, or a JSON list of objects as given on the command line.
+func parseVSphereRoles(raw []interface{}) ([]*vsphereRole, error) {
+	var roles []*vsphereRole
+	for _, item := range raw {
+		switch v := item.(type) {
+		case string:
+			v = strings.TrimSpace(v)
+			if strings.HasPrefix(v, "[") || strings.HasPrefix(v, "{") {
+				parsed, err := decodeVSphereRoles([]byte(v))
+				if err != nil {
+					return nil, err
+				}
+				roles = append(roles, parsed...)
+				continue
+			}
+			for _, name := range strutil.ParseStringSlice(v, ",") {
+				roles = append(roles, &vsphereRole{RoleName: name})
+			}
+		case map[string]interface{}:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			parsed, err := decodeVSphereRoles(encoded)
+			if err != nil {
+				return nil, err
+			}
+			roles = append(roles, parsed...)
+		default:
+			return nil, fmt.Errorf("unexpected value %v", item)
+		}
+	}
+
+	for _, r := range roles {
+		if r.RoleName == "" {
+			return nil, errors.New("role_name is required")
+		}
+		for i, folder := range r.Folders {
+			r.Folders[i] = normalizeInventoryPath(folder)
+		}
+		for _, tag := range r.Tags {
+			if tag == nil || tag.Category == "" || tag.Tag == "" {
+				return nil, errors.New("the tags require a category and a tag")
+			}
+		}
+	}
+	return roles, nil
+}
+
+// decodeVSphereRoles decodes a JSON role name, object or list of them, rejecting the unknown fields.
+func decodeVSphereRoles(data []byte) ([]*vsphereRole, error) {
+	data = bytes.TrimSpace(data)
+	if !bytes.HasPrefix(data, []byte("[")) {
+		data = append(append([]byte("["), data...), ']')
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, err
+	}
+
+	type plain vsphereRole
+	roles := make([]*vsphereRole, 0, len(items))
+	for _, item := range items {
+		var name string
+		if err := json.Unmarshal(item, &name); err == nil {
+			roles = append(roles, &vsphereRole{RoleName: name})
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(item))
+		decoder.DisallowUnknownFields()
+		r := new(plain)
+		if err := decoder.Decode(r); err != nil {
+			return nil, err
+		}
+		roles = append(roles, (*vsphereRole)(r))
+	}
+	return roles, nil
+}
+
+// normalizeInventoryPath returns an inventory path relative to the root folder, with a leading slash.
+func normalizeInventoryPath(path string) string {
+	return "/" + strings.Trim(strings.TrimSpace(path), "/")
+}
+
+// saveRole stores a role with its password encrypted with the role key of the mount.
+func (b *vsphereSecretBackend) saveRole(ctx context.Context, s logical.Storage, role *roleEntry, name string) error {
+	b.roleKeyLock.Lock()
+	defer b.roleKeyLock.Unlock()
+
+	keyring, err := b.roleKeyring(ctx, s)
+	if err != nil {
+		return err
+	}
+	return storeRole(ctx, s, keyring, role, name)
+}
+
+func storeRole(ctx context.Context, s logical.Storage, keyring *roleKeyring, role *roleEntry, name string) error {
+	stored := *role
+	stored.SchemaVersion = roleSchemaVersion
+	stored.Password, stored.EncryptedPassword = "", ""
+	if role.Password != "" {
+		encrypted, err := keyring.encrypt(name, role.Password)
+		if err != nil {
+			return errwrap.Wrapf("error encrypting the password: {{err}}", err)
+		}
+		stored.EncryptedPassword = encrypted
+	}
+
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", rolesStoragePath, name), &stored)
 	if err != nil {
 		return err
 	}
@@ -322,6 +831,7 @@ func saveRole(ctx context.Context, s logical.Storage, c *roleEntry, name string)
 	return s.Put(ctx, entry)
 }
 
+// getRole reads a role and decrypts its password.
 func getRole(ctx context.Context, name string, s logical.Storage) (*roleEntry, error) {
 	entry, err := s.Get(ctx, fmt.Sprintf("%s/%s", rolesStoragePath, name))
 	if err != nil {
@@ -336,6 +846,24 @@ func getRole(ctx context.Context, name string, s logical.Storage) (*roleEntry, e
 	if err := entry.DecodeJSON(role); err != nil {
 		return nil, err
 	}
+	if role.SchemaVersion > roleSchemaVersion {
+		return nil, fmt.Errorf("role '%s' was stored with the schema version %d, newer than the version %d of the plugin", name, role.SchemaVersion, roleSchemaVersion)
+	}
+
+	if role.EncryptedPassword != "" {
+		keyring, err := getRoleKeyring(ctx, s)
+		if err != nil {
+			return nil, err
+		}
+		if keyring == nil {
+			return nil, errors.New("the role key does not exist")
+		}
+		role.Password, err = keyring.decrypt(name, role.EncryptedPassword)
+		if err != nil {
+			return nil, errwrap.Wrapf("error decrypting the password: {{err}}", err)
+		}
+		role.EncryptedPassword = ""
+	}
 	return role, nil
 }
 
@@ -0,0 +1,202 @@
+package vspheresecrets
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const roleMigrationStoragePath = "roles-migrate"
+
+// roleMigrationStatus is the result of the last migration of the stored roles to the current schema.
+type roleMigrationStatus struct {
+	SchemaVersion int               `json:"schema_version"`
+	Migrated      []string          `json:"migrated"`
+	Failed        map[string]string `json:"failed"`
+	MigratedAt    time.Time         `json:"migrated_at"`
+}
+
+func pathRolesMigrate(b *vsphereSecretBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles-migrate$",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathRolesMigrateRead,
+			logical.UpdateOperation: b.pathRolesMigrateWrite,
+		},
+		HelpSynopsis:    rolesMigrateHelpSyn,
+		HelpDescription: rolesMigrateHelpDesc,
+	}
+}
+
+func (b *vsphereSecretBackend) pathRolesMigrateRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	status, err := getRoleMigrationStatus(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := pendingRoleMigrations(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{
+		"schema_version": roleSchemaVersion,
+		"pending":        pending,
+	}
+	if status != nil {
+		data["migrated"] = status.Migrated
+		data["failed"] = status.Failed
+		data["migrated_at"] = status.MigratedAt.Format(time.RFC3339)
+	}
+	return &logical.Response{Data: data}, nil
+}
+
+func (b *vsphereSecretBackend) pathRolesMigrateWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	status, err := b.migrateRoles(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"schema_version": status.SchemaVersion,
+			"migrated":       status.Migrated,
+			"failed":         status.Failed,
+			"migrated_at":    status.MigratedAt.Format(time.RFC3339),
+		},
+	}, nil
+}
+
+// initialize upgrades the stored roles to the current schema when the mount is initialized.
+// The roles that can not be upgraded are reported by roles-migrate and still upgraded on read.
+func (b *vsphereSecretBackend) initialize(ctx context.Context, req *logical.InitializationRequest) error {
+	// The storage of the performance secondaries and standbys is written by the primary.
+	replicationState := b.System().ReplicationState()
+	if replicationState.HasState(consts.ReplicationPerformanceSecondary | consts.ReplicationPerformanceStandby) {
+		return nil
+	}
+
+	pending, err := pendingRoleMigrations(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	status, err := b.migrateRoles(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+	b.Logger().Info("migrated the stored roles", "schema_version", status.SchemaVersion,
+		"migrated", len(status.Migrated), "failed", len(status.Failed))
+	return nil
+}
+
+// migrateRoles stores the roles of the previous schema versions with the current one and records the result.
+func (b *vsphereSecretBackend) migrateRoles(ctx context.Context, s logical.Storage) (*roleMigrationStatus, error) {
+	pending, err := pendingRoleMigrations(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &roleMigrationStatus{
+		SchemaVersion: roleSchemaVersion,
+		Migrated:      []string{},
+		Failed:        make(map[string]string),
+		MigratedAt:    time.Now(),
+	}
+	for _, name := range pending {
+		if err := b.migrateRole(ctx, s, name); err != nil {
+			status.Failed[name] = err.Error()
+			continue
+		}
+		status.Migrated = append(status.Migrated, name)
+	}
+
+	entry, err := logical.StorageEntryJSON(roleMigrationStoragePath, status)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return nil, errwrap.Wrapf("error storing the migration status: {{err}}", err)
+	}
+	return status, nil
+}
+
+// migrateRole upgrades a stored role to the current schema, unless it was updated meanwhile.
+func (b *vsphereSecretBackend) migrateRole(ctx context.Context, s logical.Storage, name string) error {
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getRole(ctx, name, s)
+	if err != nil {
+		return err
+	}
+	if role == nil || role.SchemaVersion == roleSchemaVersion {
+		return nil
+	}
+	// the version 1 accepted several vSphere roles granted on the root folder, of which only the last
+	// one was granted: the role has to be updated with a single one
+	if err := role.validateEntityRoles(); err != nil {
+		return err
+	}
+	return b.saveRole(ctx, s, role, name)
+}
+
+// pendingRoleMigrations returns the names of the roles stored with a previous schema version.
+func pendingRoleMigrations(ctx context.Context, s logical.Storage) ([]string, error) {
+	names, err := s.List(ctx, rolesStoragePath+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing roles: {{err}}", err)
+	}
+
+	pending := []string{}
+	for _, name := range names {
+		entry, err := s.Get(ctx, fmt.Sprintf("%s/%s", rolesStoragePath, name))
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		var stored struct {
+			SchemaVersion int `json:"schema_version"`
+		}
+		if err := entry.DecodeJSON(&stored); err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("error decoding role '%s': {{err}}", name), err)
+		}
+		if stored.SchemaVersion < roleSchemaVersion {
+			pending = append(pending, name)
+		}
+	}
+	return pending, nil
+}
+
+func getRoleMigrationStatus(ctx context.Context, s logical.Storage) (*roleMigrationStatus, error) {
+	entry, err := s.Get(ctx, roleMigrationStoragePath)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	status := new(roleMigrationStatus)
+	if err := entry.DecodeJSON(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+const rolesMigrateHelpSyn = `Report and run the migration of the stored roles to the current schema.`
+const rolesMigrateHelpDesc = `
+The roles stored by the previous versions of the plugin are upgraded to the current schema
+when the mount is initialized, and on read until then. Reading this endpoint returns the
+schema version of the plugin, the roles still pending a migration and the result of the
+last migration. Writing to it migrates the pending roles again.
+`
@@ -0,0 +1,74 @@
+package vspheresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRolesMigrate(t *testing.T) {
+	b, s := getTestBackend(t, false)
+	ctx := context.Background()
+
+	// roles stored by the version 1 of the schema
+	for name, role := range map[string]map[string]interface{}{
+		"static":  {"username": "administrator@vsphere.local", "password": "legacy-passw0rd"},
+		"dynamic": {"username": "vault-???", "vsphere_roles": []string{"ReadOnly"}},
+	} {
+		entry, err := logical.StorageEntryJSON(rolesStoragePath+"/"+name, role)
+		nilErr(t, err)
+		nilErr(t, s.Put(ctx, entry))
+	}
+	// a role stored by a newer version of the plugin
+	nilErr(t, s.Put(ctx, &logical.StorageEntry{
+		Key:   rolesStoragePath + "/newer",
+		Value: []byte(`{"schema_version":99,"username":"vault-???"}`),
+	}))
+
+	t.Run("Read", func(t *testing.T) {
+		resp := testRequest(t, b, s, logical.ReadOperation, "roles/dynamic", nil)
+		equal(t, []*vsphereRole{{RoleName: "ReadOnly"}}, resp.Data["vsphere_roles"])
+
+		resp = testRequest(t, b, s, logical.ReadOperation, "roles-migrate", nil)
+		equal(t, []string{"dynamic", "static"}, resp.Data["pending"])
+	})
+
+	t.Run("Initialize", func(t *testing.T) {
+		nilErr(t, b.Initialize(ctx, &logical.InitializationRequest{Storage: s}))
+
+		resp := testRequest(t, b, s, logical.ReadOperation, "roles-migrate", nil)
+		equal(t, []string{}, resp.Data["pending"])
+		equal(t, []string{"dynamic", "static"}, resp.Data["migrated"])
+		equal(t, 0, len(resp.Data["failed"].(map[string]string)))
+
+		entry, err := s.Get(ctx, rolesStoragePath+"/static")
+		nilErr(t, err)
+		if !strings.Contains(string(entry.Value), `"schema_version":2`) || strings.Contains(string(entry.Value), "legacy-passw0rd") {
+			t.Fatalf("expected the role to be stored with the current schema, got %s", entry.Value)
+		}
+		role, err := getRole(ctx, "static", s)
+		nilErr(t, err)
+		equal(t, "legacy-passw0rd", role.Password)
+
+		entry, err = s.Get(ctx, rolesStoragePath+"/dynamic")
+		nilErr(t, err)
+		if !strings.Contains(string(entry.Value), `"vsphere_roles":[{"role_name":"ReadOnly"}]`) {
+			t.Fatalf("expected the vSphere roles to be stored as objects, got %s", entry.Value)
+		}
+	})
+
+	t.Run("Newer", func(t *testing.T) {
+		if _, err := getRole(ctx, "newer", s); err == nil {
+			t.Fatal("expected a role of a newer schema to be rejected")
+		}
+
+		// the roles of newer schemas are left as they are
+		resp := testRequest(t, b, s, logical.UpdateOperation, "roles-migrate", nil)
+		equal(t, []string{}, resp.Data["migrated"])
+		entry, err := s.Get(ctx, rolesStoragePath+"/newer")
+		nilErr(t, err)
+		equal(t, `{"schema_version":99,"username":"vault-???"}`, string(entry.Value))
+	})
+}
@@ -0,0 +1,238 @@
+package vspheresecrets
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/list"
+)
+
+// maxPreviewEntities bounds the number of entities a preview expands the bindings to.
+const maxPreviewEntities = 1000
+
+// previewContainers are the types of the inventory objects whose permissions propagate to their children.
+var previewContainers = map[string]bool{
+	"Folder":                 true,
+	"StoragePod":             true,
+	"Datacenter":             true,
+	"ComputeResource":        true,
+	"ClusterComputeResource": true,
+	"ResourcePool":           true,
+	"VirtualApp":             true,
+}
+
+// previewEntity is an inventory object with the vSphere roles a dynamic user would have on it.
+type previewEntity struct {
+	Path  string
+	Type  string
+	MoRef string
+	Roles []string
+	// distance to the bindings of the roles: the closest bindings take precedence.
+	distance int
+}
+
+func pathRolePreview(b *vsphereSecretBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + framework.GenericNameRegex("name") + "/preview$",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role.",
+			},
+			"target": {
+				Type:        framework.TypeString,
+				Description: "Inventory path of the target to preview, for the roles with allowed_targets.",
+				Query:       true,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathRolePreviewRead,
+		},
+		HelpSynopsis:    rolePreviewHelpSyn,
+		HelpDescription: rolePreviewHelpDesc,
+	}
+}
+
+// pathRolePreviewRead resolves the bindings of a role and expands them to the entities they propagate to,
+// with the privileges a dynamic user of the role would have on each of them. Nothing is changed in vCenter.
+func (b *vsphereSecretBackend) pathRolePreviewRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	role, err := getRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading role: {{err}}", err)
+	}
+	if role == nil {
+		return nil, nil
+	}
+	if role.Password != "" {
+		return logical.ErrorResponse(fmt.Sprintf("role '%s' uses an existing user: only the roles of dynamic users can be previewed", name)), nil
+	}
+	role, err = b.identityRole(req, role)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	client, err := b.getConnectionClient(ctx, req.Storage, role.Connection)
+	if err != nil {
+		return nil, err
+	}
+	vsphereRoles, err := client.provider.ListRoles(ctx)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing the vSphere roles: {{err}}", err)
+	}
+	privileges := make(map[string][]string, len(vsphereRoles))
+	for _, r := range vsphereRoles {
+		privileges[r.Name] = r.Privilege
+	}
+
+	finder := find.NewFinder(client.provider.GetMountGovmomiClient().Client)
+	entities := make(map[string]*previewEntity)
+	truncated := false
+
+	var resolved []roleBinding
+	if len(role.AllowedTargets) != 0 {
+		target := normalizeInventoryPath(d.Get("target").(string))
+		if !role.allowsTarget(target) {
+			return logical.ErrorResponse(fmt.Sprintf("target '%s' is not allowed by role '%s'", target, name)), nil
+		}
+		resolved = role.targetBindings(target)
+	} else if resolved, err = client.resolveBindings(ctx, role); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	bindings := make([]map[string]interface{}, 0)
+	for _, binding := range resolved {
+		if _, ok := privileges[binding.Role]; !ok {
+			return logical.ErrorResponse(fmt.Sprintf("vSphere role '%s' does not exist", binding.Role)), nil
+		}
+		roots, err := finder.ManagedObjectList(ctx, binding.Path)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("error looking up '%s': {{err}}", binding.Path), err)
+		}
+		if len(roots) == 0 {
+			return logical.ErrorResponse(fmt.Sprintf("inventory object '%s' does not exist", binding.Path)), nil
+		}
+		bindings = append(bindings, map[string]interface{}{
+			"role":       binding.Role,
+			"path":       binding.Path,
+			"moref":      roots[0].Object.Reference().String(),
+			"privileges": sortedPrivileges(privileges[binding.Role]),
+		})
+
+		complete, err := expandBinding(ctx, finder, binding.Role, roots[:1], entities)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("error expanding '%s': {{err}}", binding.Path), err)
+		}
+		truncated = truncated || !complete
+	}
+
+	expanded := make([]map[string]interface{}, 0, len(entities))
+	for _, e := range entities {
+		var effective []string
+		for _, r := range e.Roles {
+			effective = strutil.MergeSlices(effective, privileges[r])
+		}
+		expanded = append(expanded, map[string]interface{}{
+			"path":       e.Path,
+			"type":       e.Type,
+			"moref":      e.MoRef,
+			"roles":      e.Roles,
+			"privileges": sortedPrivileges(effective),
+		})
+	}
+	sort.Slice(expanded, func(i, j int) bool {
+		return expanded[i]["path"].(string) < expanded[j]["path"].(string)
+	})
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"bindings":     bindings,
+			"entities":     expanded,
+			"entity_count": len(expanded),
+			"truncated":    truncated,
+		},
+	}
+	if truncated {
+		resp.AddWarning(fmt.Sprintf("the preview is limited to %d entities", maxPreviewEntities))
+	}
+	if len(role.VSphereGroups) != 0 {
+		resp.AddWarning("the privileges granted to the vsphere_groups of the role are not included")
+	}
+	return resp, nil
+}
+
+// expandBinding walks the inventory below the root of a binding and records the role on each entity,
+// unless a closer binding grants other roles on it. Entities reached through several hierarchies,
+// such as the virtual machines of a folder and of a resource pool, get the roles of the closest bindings.
+// It returns false when the walk stopped at maxPreviewEntities.
+func expandBinding(ctx context.Context, finder *find.Finder, role string, level []list.Element, entities map[string]*previewEntity) (bool, error) {
+	for distance := 0; len(level) != 0; distance++ {
+		var next []list.Element
+		for _, e := range level {
+			ref := e.Object.Reference()
+			entity, ok := entities[ref.String()]
+			switch {
+			case !ok:
+				if len(entities) >= maxPreviewEntities {
+					return false, nil
+				}
+				entities[ref.String()] = &previewEntity{
+					Path:     e.Path,
+					Type:     ref.Type,
+					MoRef:    ref.String(),
+					Roles:    []string{role},
+					distance: distance,
+				}
+			case distance < entity.distance:
+				entity.Roles, entity.distance = []string{role}, distance
+			case distance == entity.distance:
+				entity.Roles = strutil.AppendIfMissing(entity.Roles, role)
+			default:
+				continue
+			}
+
+			if !previewContainers[ref.Type] {
+				continue
+			}
+			children, err := finder.ManagedObjectListChildren(ctx, e.Path)
+			if err != nil {
+				return false, err
+			}
+			next = append(next, children...)
+		}
+		level = next
+	}
+	return true, nil
+}
+
+func sortedPrivileges(privileges []string) []string {
+	sorted := append([]string{}, privileges...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+const rolePreviewHelpSyn = `Preview the privileges granted by a role.`
+const rolePreviewHelpDesc = `
+This endpoint resolves the vsphere_roles and privileges of a role to the inventory objects
+they are granted on, and expands them to the objects they propagate to. Each object is listed
+with the vSphere roles and the privileges a dynamic user of the role would have on it: the
+roles granted on the closest parent take precedence over the roles granted higher in the
+inventory. The dynamic users do not exist before they are issued, so the privileges are
+computed from the role definitions rather than queried from vCenter, and nothing is changed.
+
+The roles with allowed_targets are previewed on the target given as a parameter.
+The preview is limited to 1000 objects. The privileges granted to the groups of the role
+are not included.
+`
@@ -0,0 +1,79 @@
+package vspheresecrets
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+)
+
+func TestRolePreview(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, true)
+	m := useMockProvider(b)
+	ctx := context.Background()
+
+	testRoleCreate(t, b, s, "preview", map[string]interface{}{
+		"vsphere_roles": `[{"role_name":"ReadOnly"},{"role_name":"Admin","folders":["DC0/vm"]}]`,
+	})
+
+	client, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	before, err := client.provider.ListUserPermissions(ctx)
+	nilErr(t, err)
+
+	resp := testRequest(t, b, s, logical.ReadOperation, "roles/preview/preview", nil)
+	equal(t, 2, len(resp.Data["bindings"].([]map[string]interface{})))
+	equal(t, false, resp.Data["truncated"])
+
+	entities := make(map[string]map[string]interface{})
+	for _, e := range resp.Data["entities"].([]map[string]interface{}) {
+		entities[e["path"].(string)] = e
+	}
+	equal(t, resp.Data["entity_count"], len(entities))
+
+	// the closest binding takes precedence
+	equal(t, []string{"ReadOnly"}, entities["/DC0"]["roles"])
+	equal(t, []string{"ReadOnly"}, entities["/DC0/host"]["roles"])
+	equal(t, []string{"Admin"}, entities["/DC0/vm"]["roles"])
+	vm := entities["/DC0/vm/DC0_H0_VM0"]
+	if vm == nil {
+		t.Fatalf("expected the virtual machines of the folder to be listed, got %v", entities)
+	}
+	equal(t, []string{"Admin"}, vm["roles"])
+	equal(t, "VirtualMachine", vm["type"])
+	if !strutil.StrListContains(vm["privileges"].([]string), "VirtualMachine.Interact.PowerOn") {
+		t.Fatal("expected the privileges of the Admin role")
+	}
+	if strutil.StrListContains(entities["/DC0"]["privileges"].([]string), "VirtualMachine.Interact.PowerOn") {
+		t.Fatal("expected the privileges of the ReadOnly role")
+	}
+
+	// nothing is changed in vCenter
+	equal(t, 0, m.userCount())
+	after, err := client.provider.ListUserPermissions(ctx)
+	nilErr(t, err)
+	equal(t, before, after)
+
+	t.Run("Invalid", func(t *testing.T) {
+		testRoleCreate(t, b, s, "static", testStaticSPRole)
+		testRoleCreate(t, b, s, "missing", map[string]interface{}{
+			"vsphere_roles": `[{"role_name":"NoSuchRole"}]`,
+		})
+		for _, name := range []string{"static", "missing"} {
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "roles/" + name + "/preview",
+				Storage:   s,
+			})
+			nilErr(t, err)
+			if !resp.IsError() {
+				t.Fatalf("expected the preview of %s to fail", name)
+			}
+		}
+	})
+}
@@ -2,10 +2,19 @@ package vspheresecrets
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
 )
 
 // Utility function to create a role and fail on errors
@@ -26,3 +35,205 @@ func testRoleCreate(t *testing.T, b *vsphereSecretBackend, s logical.Storage, na
 		t.Fatal(resp.Error())
 	}
 }
+
+func TestRoleDeleteLeases(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, true)
+	m := useMockProvider(b)
+	ctx := context.Background()
+	admin := testAdminClient(t)
+
+	testRoleCreate(t, b, s, "dynamic", testDynamicSPRole)
+	dynamic := testRequest(t, b, s, logical.ReadOperation, "session/dynamic", nil)
+	username := dynamic.Data["username"].(string)
+
+	testRoleCreate(t, b, s, "static", testStaticSPRole)
+	static := testRequest(t, b, s, logical.ReadOperation, "session/static", nil)
+	key := testSessionKey(t, testUnmarshalSession(t, static.Data["govmomiclient"]))
+
+	t.Run("Refused", func(t *testing.T) {
+		for _, name := range []string{"dynamic", "static"} {
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.DeleteOperation,
+				Path:      "roles/" + name,
+				Storage:   s,
+			})
+			nilErr(t, err)
+			if !resp.IsError() {
+				t.Fatal("expected the deletion of a role with active leases to be refused")
+			}
+		}
+		if !m.userExists(username) || !testSessionIsActive(t, admin, key) {
+			t.Fatal("expected the leases to be kept")
+		}
+	})
+
+	t.Run("Force", func(t *testing.T) {
+		testRequest(t, b, s, logical.DeleteOperation, "roles/dynamic", map[string]interface{}{"force": true})
+		if m.userExists(username) {
+			t.Fatal("expected the user to be deleted")
+		}
+		equal(t, 0, len(testUserRootRoles(t, b, s, username)))
+
+		testRequest(t, b, s, logical.DeleteOperation, "roles/static", map[string]interface{}{"force": true})
+		if testSessionIsActive(t, admin, key) {
+			t.Fatal("expected the session to be logged out")
+		}
+
+		for _, name := range []string{"dynamic", "static"} {
+			role, err := getRole(ctx, name, s)
+			nilErr(t, err)
+			if role != nil {
+				t.Fatalf("expected the role %s to be deleted", name)
+			}
+		}
+	})
+
+	// the leases can no longer be renewed, and their revocation is a no-op
+	t.Run("Leases", func(t *testing.T) {
+		for _, secret := range []*logical.Secret{dynamic.Secret, static.Secret} {
+			fakeSaveLoad(secret)
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.RenewOperation,
+				Secret:    secret,
+				Storage:   s,
+			})
+			if err == nil && !resp.IsError() {
+				t.Fatal("expected the renewal to fail")
+			}
+		}
+
+		for _, resp := range []*logical.Response{dynamic, static} {
+			revoked, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.RevokeOperation,
+				Secret:    resp.Secret,
+				Data:      resp.Data,
+				Storage:   s,
+			})
+			nilErr(t, err)
+			if revoked != nil && revoked.IsError() {
+				t.Fatal(revoked.Error())
+			}
+		}
+	})
+}
+
+// testUnmarshalSession returns the client of a session returned by a static role.
+func testUnmarshalSession(t *testing.T, clientMarshaled interface{}) *govmomi.Client {
+	t.Helper()
+	raw, err := json.Marshal(clientMarshaled)
+	nilErr(t, err)
+	c := &govmomi.Client{Client: new(vim25.Client)}
+	nilErr(t, c.UnmarshalJSON(raw))
+	c.SessionManager = session.NewManager(c.Client)
+	return c
+}
+
+func TestRolePrivileges(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, true)
+	m := useMockProvider(b)
+	ctx := context.Background()
+
+	client, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	authz := object.NewAuthorizationManager(client.provider.GetMountGovmomiClient().Client)
+	testPrivileges := func(t *testing.T, name string) []string {
+		t.Helper()
+		roles, err := authz.RoleList(ctx)
+		nilErr(t, err)
+		role := roles.ByName(name)
+		if role == nil {
+			return nil
+		}
+		return role.Privilege
+	}
+
+	testRoleCreate(t, b, s, "power", map[string]interface{}{
+		"username":   "vault-power-????",
+		"privileges": "VirtualMachine.Interact.PowerOn",
+	})
+	resp := testRequest(t, b, s, logical.ReadOperation, "roles/power", nil)
+	vsphereRole := resp.Data["privilege_role"].(string)
+	if !strings.HasPrefix(vsphereRole, "vault-power-") {
+		t.Fatalf("unexpected vSphere role name %s", vsphereRole)
+	}
+	if !strutil.StrListContains(testPrivileges(t, vsphereRole), "VirtualMachine.Interact.PowerOn") {
+		t.Fatal("expected the vSphere role to be created with the privileges")
+	}
+
+	t.Run("Update", func(t *testing.T) {
+		testRoleCreate(t, b, s, "power", map[string]interface{}{
+			"privileges": "VirtualMachine.Interact.PowerOff",
+		})
+		privileges := testPrivileges(t, vsphereRole)
+		if strutil.StrListContains(privileges, "VirtualMachine.Interact.PowerOn") || !strutil.StrListContains(privileges, "VirtualMachine.Interact.PowerOff") {
+			t.Fatalf("expected the privileges of the vSphere role to be replaced, got %v", privileges)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		for _, data := range []map[string]interface{}{
+			{"privileges": "VirtualMachine.Interact.NoSuchPrivilege"},
+			{"privileges": "VirtualMachine.Interact.PowerOn", "vsphere_roles": "ReadOnly"},
+			{"privileges": "VirtualMachine.Interact.PowerOn", "username": "root", "password": "root"},
+		} {
+			resp, err := b.HandleRequest(ctx, &logical.Request{
+				Operation: logical.CreateOperation,
+				Path:      "roles/invalid",
+				Data:      data,
+				Storage:   s,
+			})
+			nilErr(t, err)
+			if !resp.IsError() {
+				t.Fatalf("expected %v to be rejected", data)
+			}
+		}
+		resp := testRequest(t, b, s, logical.ReadOperation, "roles/invalid", nil)
+		if resp != nil {
+			t.Fatal("expected no role to be created")
+		}
+	})
+
+	t.Run("Issue", func(t *testing.T) {
+		resp := testRequest(t, b, s, logical.ReadOperation, "session/power", nil)
+		username := resp.Data["username"].(string)
+		equal(t, []string{vsphereRole}, testUserRootRoles(t, b, s, username))
+
+		// the vSphere role is deleted with the Vault role once the leases are revoked
+		testRequest(t, b, s, logical.DeleteOperation, "roles/power", map[string]interface{}{"force": true})
+		if m.userExists(username) {
+			t.Fatal("expected the user to be deleted")
+		}
+		if testPrivileges(t, vsphereRole) != nil {
+			t.Fatal("expected the vSphere role to be deleted")
+		}
+	})
+
+	t.Run("StillGranted", func(t *testing.T) {
+		testRoleCreate(t, b, s, "shared", map[string]interface{}{
+			"privileges": "VirtualMachine.Interact.PowerOn",
+		})
+		resp := testRequest(t, b, s, logical.ReadOperation, "roles/shared", nil)
+		vsphereRole := resp.Data["privilege_role"].(string)
+
+		// the vSphere role was granted outside of Vault: it is kept
+		dc, err := find.NewFinder(client.provider.GetMountGovmomiClient().Client).DefaultDatacenter(ctx)
+		nilErr(t, err)
+		permissions := []vspherePermission{{Entity: dc.Reference().String(), Role: vsphereRole}}
+		nilErr(t, client.provider.GrantPermissions(ctx, "someone", permissions))
+
+		resp = testRequest(t, b, s, logical.DeleteOperation, "roles/shared", nil)
+		if resp == nil || len(resp.Warnings) == 0 {
+			t.Fatal("expected a warning")
+		}
+		if testPrivileges(t, vsphereRole) == nil {
+			t.Fatal("expected the vSphere role to be kept")
+		}
+		nilErr(t, client.provider.RevokePermissions(ctx, "someone", permissions))
+	})
+}
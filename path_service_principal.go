@@ -5,13 +5,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/errwrap"
+	uuid "github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/base62"
 	"github.com/hashicorp/vault/sdk/helper/locksutil"
 	"github.com/hashicorp/vault/sdk/logical"
 	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
 )
 
 const (
@@ -19,8 +24,10 @@ const (
 	SecretTypeStaticSP = "static_service_principal"
 )
 
-// SPs will be created with a far-future expiration in Azure... relvant for vSphere?
-var spExpiration = 10 * 365 * 24 * time.Hour
+const (
+	passwordPrefix = "Va1-"
+	passwordLength = 20
+)
 
 func secretServicePrincipal(b *vsphereSecretBackend) *framework.Secret {
 	return &framework.Secret{
@@ -46,6 +53,11 @@ func pathServicePrincipal(b *vsphereSecretBackend) *framework.Path {
 				Type:        framework.TypeLowerCaseString,
 				Description: "Name of the Vault role",
 			},
+			"target": {
+				Type:        framework.TypeString,
+				Description: "Inventory path of the object to grant the role on, matching the allowed_targets of the role.",
+				Query:       true,
+			},
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.ReadOperation: b.pathSPRead,
@@ -59,6 +71,10 @@ func pathServicePrincipal(b *vsphereSecretBackend) *framework.Path {
 func (b *vsphereSecretBackend) pathSPRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	roleName := d.Get("role").(string)
 
+	lock := locksutil.LockForKey(b.roleLocks, roleName)
+	lock.RLock()
+	defer lock.RUnlock()
+
 	role, err := getRole(ctx, roleName, req.Storage)
 	if err != nil {
 		return nil, err
@@ -68,17 +84,61 @@ func (b *vsphereSecretBackend) pathSPRead(ctx context.Context, req *logical.Requ
 		return logical.ErrorResponse(fmt.Sprintf("role '%s' does not exist", roleName)), nil
 	}
 
+	templated := role.hasIdentityTemplates()
+	role, err = b.identityRole(req, role)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	// the roles stored before the check, or whose identity templates populate to the same folder
+	if err := role.validateEntityRoles(); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("role '%s' must be updated: %s", roleName, err)), nil
+	}
+	// the username is only fully known once the identity templates are populated
+	if templated && role.Password == "" {
+		if err := validateUsernameTemplate(role.Username); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid username: %s", err)), nil
+		}
+	}
+
 	var resp *logical.Response
 
-	client, err := b.getClient(ctx, req.Storage)
+	client, err := b.getConnectionClient(ctx, req.Storage, role.Connection)
 	if err != nil {
 		return nil, err
 	}
 
 	if role.Password != "" {
-		resp, err = b.createStaticSPSecret(ctx, client, roleName, role)
+		resp, err = b.createStaticSPSecret(ctx, req.Storage, client, roleName, role)
 	} else {
-		resp, err = b.createSPSecret(ctx, client, roleName, role)
+		var bindings []roleBinding
+		target := d.Get("target").(string)
+		switch {
+		case len(role.AllowedTargets) == 0 && target != "":
+			return logical.ErrorResponse(fmt.Sprintf("role '%s' does not define allowed_targets", roleName)), nil
+		case len(role.AllowedTargets) == 0:
+			bindings, err = client.resolveBindings(ctx, role)
+			if err != nil {
+				return nil, err
+			}
+		case target == "":
+			return logical.ErrorResponse(fmt.Sprintf("role '%s' requires a target", roleName)), nil
+		default:
+			target = normalizeInventoryPath(target)
+			if !role.allowsTarget(target) {
+				return logical.ErrorResponse(fmt.Sprintf("target '%s' is not allowed by role '%s'", target, roleName)), nil
+			}
+			bindings = role.targetBindings(target)
+		}
+		// the guardrails, the vSphere roles or the tagged objects may have changed since the role was written
+		var violations []string
+		violations, err = b.roleGuardrailViolations(ctx, req.Storage, role.Connection, bindings, role.VSphereGroups, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(violations) != 0 {
+			return logical.ErrorResponse(fmt.Sprintf("role '%s' violates the guardrails of the mount: %s", roleName, strings.Join(violations, "; "))), nil
+		}
+		resp, err = b.createSPSecret(ctx, req.Storage, client, roleName, role, bindings, target)
 	}
 
 	if err != nil {
@@ -90,58 +150,133 @@ func (b *vsphereSecretBackend) pathSPRead(ctx context.Context, req *logical.Requ
 	return resp, nil
 }
 
-// createSPSecret generates a new App/Service Principal.
-func (b *vsphereSecretBackend) createSPSecret(ctx context.Context, c *client, roleName string, role *roleEntry) (*logical.Response, error) {
-	/*
-		// Create the App, which is the top level object to be tracked in the secret
-		// and deleted upon revocation. If any subsequent step fails, the App is deleted.
-		app, err := c.createApp(ctx)
-		if err != nil {
-			return nil, err
-		}
-		appID := to.String(app.AppID)
-		appObjID := to.String(app.ObjectID)
+// dynamicUser is a SSO user created for a lease, with the permissions granted to it.
+// It is recorded in the WAL before its creation and in the internal data of the lease.
+type dynamicUser struct {
+	Role        string              `json:"role"`
+	Connection  string              `json:"connection"`
+	Username    string              `json:"username"`
+	Groups      []string            `json:"groups,omitempty"`
+	Permissions []vspherePermission `json:"permissions,omitempty"`
+	// Target is the inventory path the permissions are granted on, when the role has allowed_targets.
+	Target string `json:"target,omitempty"`
+}
 
-		// Create a service principal associated with the new App
-		sp, password, err := c.createSP(ctx, app, spExpiration)
-		if err != nil {
-			c.deleteApp(ctx, appObjID)
-			return nil, err
-		}
+// createSPSecret creates a SSO user with the groups of the role and the vSphere roles of its resolved bindings.
+// The user is recorded in the WAL before it is created, so that a failure or a crash
+// before the lease is returned does not leave it behind. The permissions are recorded in the lease,
+// so that the objects granted through tags are revoked even when the tags change.
+func (b *vsphereSecretBackend) createSPSecret(ctx context.Context, s logical.Storage, c *client, roleName string, role *roleEntry, bindings []roleBinding, target string) (*logical.Response, error) {
+	username, err := c.generateUniqueUsername(ctx, role.Username, role.UsernameCharset)
+	if err != nil {
+		return nil, err
+	}
+	password, err := generatePassword()
+	if err != nil {
+		return nil, err
+	}
 
-		// Assign Azure roles to the new SP
-		raIDs, err := c.assignRoles(ctx, sp, role.AzureRoles)
-		if err != nil {
-			c.deleteApp(ctx, appObjID)
-			return nil, err
-		}
+	permissions, err := c.rolePermissions(ctx, bindings)
+	if err != nil {
+		return nil, err
+	}
+	user := &dynamicUser{
+		Role:        roleName,
+		Connection:  role.Connection,
+		Username:    username,
+		Groups:      role.VSphereGroups,
+		Permissions: permissions,
+		Target:      target,
+	}
 
-		// Assign Azure group memberships to the new SP
-		if err := c.addGroupMemberships(ctx, sp, role.AzureGroups); err != nil {
-			c.deleteApp(ctx, appObjID)
-			return nil, err
+	walID, err := framework.PutWAL(ctx, s, walUserKind, &walUser{
+		dynamicUser: *user,
+		Expiration:  time.Now().Add(maxWALAge),
+	})
+	if err != nil {
+		return nil, errwrap.Wrapf("error writing WAL: {{err}}", err)
+	}
+
+	// cleanup deletes the user right away. The WAL rolls back what was created when it fails too.
+	cleanup := func() {
+		if err := c.deleteUser(ctx, user); err != nil {
+			b.Logger().Warn("error cleaning up the user, it will be rolled back", "username", username, "error", err)
+		} else if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+			b.Logger().Warn("error deleting WAL", "error", err)
 		}
-	*/
+	}
+
+	mountID, err := b.mountID(ctx, s)
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	if err := c.createUser(ctx, user, password, managedUserDescription(mountID, time.Now())); err != nil {
+		cleanup()
+		return nil, err
+	}
+
 	data := map[string]interface{}{
-		"username": role.Username,
-		"password": role.Password,
-		// "client_id":     appID,
-		// "client_secret": password,
+		"username":  username,
+		"password":  password,
+		"url":       redactURL(c.settings.URL),
+		"endpoints": c.endpointURLs(ctx),
+	}
+	if target != "" {
+		data["target"] = target
+	}
+	if role.SSOToken {
+		signer, err := c.provider.IssueUserToken(ctx, username, password, b.roleTTL(role), false, false)
+		if err != nil {
+			cleanup()
+			return nil, errwrap.Wrapf("error issuing the SSO token: {{err}}", err)
+		}
+		data["token"] = signer.Token
 	}
+
 	internalData := map[string]interface{}{
-		// "app_object_id": appObjID,
-		// "sp_object_id":  sp.ObjectID,
-		// "role_assignment_ids":  raIDs,
-		// "group_membership_ids": groupObjectIDs(role.AzureGroups),
-		"role": roleName,
+		"role":        roleName,
+		"connection":  user.Connection,
+		"username":    user.Username,
+		"groups":      user.Groups,
+		"permissions": user.Permissions,
+		"target":      user.Target,
 	}
+	resp := b.Secret(SecretTypeSP).Response(data, internalData)
 
-	return b.Secret(SecretTypeSP).Response(data, internalData), nil
+	if err := savePrincipal(ctx, s, user); err != nil {
+		cleanup()
+		return nil, errwrap.Wrapf("error indexing the user: {{err}}", err)
+	}
 
+	// The user is fully created and revoked with the lease from now on.
+	if err := framework.DeleteWAL(ctx, s, walID); err != nil {
+		return nil, errwrap.Wrapf("error deleting WAL: {{err}}", err)
+	}
+
+	return resp, nil
+}
+
+// roleTTL returns the TTL of the role or the default lease TTL of the mount.
+func (b *vsphereSecretBackend) roleTTL(role *roleEntry) time.Duration {
+	if role.TTL == 0 {
+		return b.System().DefaultLeaseTTL()
+	}
+	return role.TTL
+}
+
+// generatePassword returns a random password that meets the default SSO password policy:
+// at most 20 characters with upper and lower case letters, a digit and a special character.
+func generatePassword() (string, error) {
+	random, err := base62.Random(passwordLength - len(passwordPrefix))
+	if err != nil {
+		return "", err
+	}
+	return passwordPrefix + random, nil
 }
 
 // createStaticSPSecret adds a new password to the App associated with the role.
-func (b *vsphereSecretBackend) createStaticSPSecret(ctx context.Context, c *client, roleName string, role *roleEntry) (*logical.Response, error) {
+func (b *vsphereSecretBackend) createStaticSPSecret(ctx context.Context, s logical.Storage, c *client, roleName string, role *roleEntry) (*logical.Response, error) {
 	lock := locksutil.LockForKey(b.appLocks, role.Username) // We probably need some ID instead of the name  role.ApplicationObjectID)
 	lock.Lock()
 	defer lock.Unlock()
@@ -156,23 +291,48 @@ func (b *vsphereSecretBackend) createStaticSPSecret(ctx context.Context, c *clie
 		return nil, err
 	}
 
-	fmt.Println("marshaledClient=", string(marshaledClient))
-
 	var clientAsMap map[string]interface{}
 	err = json.Unmarshal(marshaledClient, &clientAsMap)
 	if err != nil {
 		return nil, err
 	}
 
+	// The session is only valid on the vCenter of the connection, at the url it was created with.
+	// The SSO token is valid on all the vCenters linked to the SSO domain.
 	data := map[string]interface{}{
 		"govmomiclient": clientAsMap,
+		"url":           redactURL(c.settings.URL),
+		"endpoints":     c.endpointURLs(ctx),
 	}
 	// TODO: data["cookie"] = the-cookie (?)
 
+	if role.SSOToken {
+		signer, err := c.provider.IssueUserToken(ctx, role.Username, role.Password, b.roleTTL(role), false, false)
+		if err != nil {
+			return nil, errwrap.Wrapf("error issuing the SSO token: {{err}}", err)
+		}
+		data["token"] = signer.Token
+	}
+
+	sessionID, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	err = saveSession(ctx, s, &sessionEntry{
+		ID:            sessionID,
+		Role:          roleName,
+		Connection:    role.Connection,
+		GovmomiClient: clientAsMap,
+		CreatedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, errwrap.Wrapf("error indexing the session: {{err}}", err)
+	}
+
 	internalData := map[string]interface{}{
-		// "app_object_id": role.ApplicationObjectID,
-		// "key_id":        keyID,
-		"role": roleName,
+		"role":       roleName,
+		"connection": role.Connection,
+		"session_id": sessionID,
 	}
 
 	return b.Secret(SecretTypeStaticSP).Response(data, internalData), nil
@@ -190,7 +350,7 @@ func (b *vsphereSecretBackend) spRenew(ctx context.Context, req *logical.Request
 	}
 
 	if role == nil {
-		return nil, nil
+		return logical.ErrorResponse(fmt.Sprintf("role '%s' was deleted", roleRaw)), nil
 	}
 
 	resp := &logical.Response{Secret: req.Secret}
@@ -200,100 +360,82 @@ func (b *vsphereSecretBackend) spRenew(ctx context.Context, req *logical.Request
 	return resp, nil
 }
 
+// spRevoke removes the permissions of the dynamic user of the lease and deletes it.
 func (b *vsphereSecretBackend) spRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	resp := new(logical.Response)
-
-	appObjectIDRaw, ok := req.Secret.InternalData["app_object_id"]
-	if !ok {
-		return nil, errors.New("internal data 'app_object_id' not found")
+	var user dynamicUser
+	if err := decodeJSON(req.Secret.InternalData, &user); err != nil {
+		return nil, errwrap.Wrapf("error decoding the internal data: {{err}}", err)
 	}
-
-	appObjectID := appObjectIDRaw.(string)
-	fmt.Println("TODO: appObjectID", appObjectID)
-
-	// Get the service principal object ID. Only set if using dynamic service
-	// principals.
-	var spObjectID string
-	if spObjectIDRaw, ok := req.Secret.InternalData["sp_object_id"]; ok {
-		spObjectID = spObjectIDRaw.(string)
+	if user.Username == "" {
+		return nil, errors.New("internal data 'username' not found")
 	}
 
-	var raIDs []string
-	if req.Secret.InternalData["role_assignment_ids"] != nil {
-		for _, v := range req.Secret.InternalData["role_assignment_ids"].([]interface{}) {
-			raIDs = append(raIDs, v.(string))
-		}
+	c, err := b.getConnectionClient(ctx, req.Storage, user.Connection)
+	if err != nil {
+		return nil, errwrap.Wrapf("error during revoke: {{err}}", err)
 	}
 
-	var gmIDs []string
-	if req.Secret.InternalData["group_membership_ids"] != nil {
-		for _, v := range req.Secret.InternalData["group_membership_ids"].([]interface{}) {
-			gmIDs = append(gmIDs, v.(string))
-		}
+	if err := c.deleteUser(ctx, &user); err != nil {
+		return nil, errwrap.Wrapf("error during revoke: {{err}}", err)
 	}
-
-	if len(gmIDs) != 0 && spObjectID == "" {
-		return nil, errors.New("internal data 'sp_object_id' not found")
+	if err := deletePrincipal(ctx, req.Storage, &user); err != nil {
+		return nil, errwrap.Wrapf("error during revoke: {{err}}", err)
 	}
+	return nil, nil
+}
 
-	_, err := b.getClient(ctx, req.Storage)
+// decodeJSON decodes the data, such as the internal data of a lease, into a struct.
+func decodeJSON(data interface{}, v interface{}) error {
+	raw, err := json.Marshal(data)
 	if err != nil {
-		return nil, errwrap.Wrapf("error during revoke: {{err}}", err)
+		return err
 	}
-
-	/*
-		// unassigning roles is effectively a garbage collection operation. Errors will be noted but won't fail the
-		// revocation process. Deleting the app, however, *is* required to consider the secret revoked.
-		if err := c.unassignRoles(ctx, raIDs); err != nil {
-			resp.AddWarning(err.Error())
-		}
-
-		// removing group membership is effectively a garbage collection
-		// operation. Errors will be noted but won't fail the revocation process.
-		// Deleting the app, however, *is* required to consider the secret revoked.
-		if err := c.removeGroupMemberships(ctx, spObjectID, gmIDs); err != nil {
-			resp.AddWarning(err.Error())
-		}
-
-		err = c.deleteApp(ctx, appObjectID)
-	*/
-	return resp, err
+	return json.Unmarshal(raw, v)
 }
 
+// staticSPRevoke logs out the session of the lease.
 func (b *vsphereSecretBackend) staticSPRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	return b.logoutFromSession(ctx, req, d)
-}
-
-func (b *vsphereSecretBackend) logoutFromSession(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	govmomiClient := &govmomi.Client{}
-
 	clientMarshaled, ok := req.Data["govmomiclient"]
 	if !ok {
 		return nil, errors.New("data 'govmomiclient' not found")
 	}
 
+	if err := logoutSession(ctx, clientMarshaled); err != nil {
+		return nil, errwrap.Wrapf("error during revoke: {{err}}", err)
+	}
+
+	// The leases issued before the sessions were indexed have no session_id.
+	role, _ := req.Secret.InternalData["role"].(string)
+	if sessionID, ok := req.Secret.InternalData["session_id"].(string); ok {
+		if err := deleteSession(ctx, req.Storage, role, sessionID); err != nil {
+			return nil, errwrap.Wrapf("error during revoke: {{err}}", err)
+		}
+	}
+	return nil, nil
+}
+
+// logoutSession logs out the session of a serialized client.
+// A session that is already logged out, for example by the cascade deletion of its role, is not an error.
+func logoutSession(ctx context.Context, clientMarshaled interface{}) error {
+	govmomiClient := &govmomi.Client{Client: new(vim25.Client)}
+
 	clientMarshaledRaw, err := json.Marshal(clientMarshaled)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// the logged in client:
 	err = govmomiClient.UnmarshalJSON(clientMarshaledRaw)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	// TODO: lock this particular session by its cookie?
-	// lock := locksutil.LockForKey(b.appLocks, appObjectID)
-	// lock.Lock()
-	// defer lock.Unlock()
+	govmomiClient.SessionManager = session.NewManager(govmomiClient.Client)
 
 	err = govmomiClient.Logout(ctx)
-	if err != nil {
-		// should it be just a warning? probably ok as this "just" ends up in the logs. we could filter eventually the "already logged out errors"
-		return nil, errwrap.Wrapf("error during revoke: {{err}}", err)
+	if err != nil && !isNotAuthenticated(err) {
+		return err
 	}
-	return nil, nil
+	return nil
 }
 
 const pathServicePrincipalHelpSyn = `
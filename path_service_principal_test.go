@@ -2,22 +2,31 @@ package vspheresecrets
 
 import (
 	"context"
+	"errors"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
 
-	"github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/types"
 )
 
 var (
 	testStaticSPRole = map[string]interface{}{
-		"username": "foo",
-		"password": "bar",
+		"username": govmomitest.SimulatorServerSudoerUsername,
+		"password": govmomitest.SimulatorServerSudoerPassword,
 	}
 )
 
 func TestStaticSPRead(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
 	b, s := getTestBackend(t, true)
 
 	// verify basic cred issuance
@@ -27,7 +36,7 @@ func TestStaticSPRead(t *testing.T) {
 
 		resp, err := b.HandleRequest(context.Background(), &logical.Request{
 			Operation: logical.ReadOperation,
-			Path:      "creds/" + name,
+			Path:      "session/" + name,
 			Storage:   s,
 		})
 
@@ -37,25 +46,37 @@ func TestStaticSPRead(t *testing.T) {
 			t.Fatalf("expected no response error, actual:%#v", resp.Error())
 		}
 
-		// verify client_id format, and that the corresponding app actually exists
-		_, err = uuid.ParseUUID(resp.Data["client_id"].(string))
-		nilErr(t, err)
-
-		keyID := resp.Secret.InternalData["key_id"].(string)
-		if !strings.HasPrefix(keyID, "ffffff") {
-			t.Fatalf("expected prefix 'ffffff': %s", keyID)
+		// verify the session is returned along with the vCenters it can be used with
+		if _, ok := resp.Data["govmomiclient"]; !ok {
+			t.Fatal("expected the logged in client to be returned")
 		}
+		if endpoints := resp.Data["endpoints"].([]string); len(endpoints) != 1 || !strings.HasPrefix(endpoints[0], govmomitest.SimulatorURLWithoutUserinfo()) {
+			t.Fatalf("expected the endpoint of the simulator, got %v", endpoints)
+		}
+		if _, ok := resp.Data["token"]; ok {
+			t.Fatal("expected no SSO token")
+		}
+		equal(t, name, resp.Secret.InternalData["role"])
+	})
 
-		// client, err := b.getClient(context.Background(), s)
-		// nilErr(t, err)
-
-		// if !client.provider.(*mockProvider).passwordExists(keyID) {
-		// 	t.Fatalf("password was not created")
-		// }
+	// verify a SSO token valid across the linked vCenters can be requested
+	t.Run("SSOToken", func(t *testing.T) {
+		name := generateUUID()
+		testRoleCreate(t, b, s, name, testStaticSPRole)
+		testRoleCreate(t, b, s, name, map[string]interface{}{"sso_token": true})
 
-		// verify password format
-		_, err = uuid.ParseUUID(resp.Data["client_secret"].(string))
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "session/" + name,
+			Storage:   s,
+		})
 		nilErr(t, err)
+		if resp.IsError() {
+			t.Fatal(resp.Error())
+		}
+		if token, _ := resp.Data["token"].(string); token == "" {
+			t.Fatal("expected a SSO token")
+		}
 	})
 
 	// verify role TTLs are reflected in secret
@@ -94,6 +115,9 @@ func TestStaticSPRead(t *testing.T) {
 }
 
 func TestStaticSPRevoke(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
 	b, s := getTestBackend(t, true)
 
 	testRoleCreate(t, b, s, "test_role", testStaticSPRole)
@@ -103,25 +127,19 @@ func TestStaticSPRevoke(t *testing.T) {
 		Path:      "session/test_role",
 		Storage:   s,
 	})
+	nilErr(t, err)
 
-	keyID := resp.Secret.InternalData["key_id"].(string)
-	if !strings.HasPrefix(keyID, "ffffff") {
-		t.Fatalf("expected prefix 'ffffff': %s", keyID)
+	if _, ok := resp.Data["govmomiclient"]; !ok {
+		t.Fatal("expected the logged in client to be returned")
 	}
 
-	// client, err := b.getClient(context.Background(), s)
-	// nilErr(t, err)
-
-	// if !client.provider.(*mockProvider).passwordExists(keyID) {
-	// 	t.Fatalf("password was not created")
-	// }
-
 	// Serialize and deserialize the secret to remove typing, as will really happen.
 	fakeSaveLoad(resp.Secret)
 
 	resp, err = b.HandleRequest(context.Background(), &logical.Request{
 		Operation: logical.RevokeOperation,
 		Secret:    resp.Secret,
+		Data:      resp.Data,
 		Storage:   s,
 	})
 
@@ -130,8 +148,346 @@ func TestStaticSPRevoke(t *testing.T) {
 	if resp.IsError() {
 		t.Fatalf("receive response error: %v", resp.Error())
 	}
+}
+
+var (
+	testDynamicSPRole = map[string]interface{}{
+		"username":       "vault-test-????",
+		"vsphere_roles":  "ReadOnly",
+		"vsphere_groups": "PerfView",
+	}
+)
+
+func TestSPRead(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	m := useMockProvider(b)
+	ctx := context.Background()
+
+	testRoleCreate(t, b, s, "dynamic", testDynamicSPRole)
+	resp := testRequest(t, b, s, logical.ReadOperation, "session/dynamic", nil)
+
+	// the user is created with a random name in its groups and granted its role
+	username := resp.Data["username"].(string)
+	if !strings.HasPrefix(username, "vault-test-") || len(username) != len("vault-test-????") || strings.Contains(username, "?") {
+		t.Fatalf("unexpected username %s", username)
+	}
+	equal(t, passwordLength, len(resp.Data["password"].(string)))
+	if !m.userExists(username) || !m.isGroupMember("PerfView", username) {
+		t.Fatal("expected the user to be created in its groups")
+	}
+	equal(t, []string{"ReadOnly"}, testUserRootRoles(t, b, s, username))
+	testWALCount(t, s, 0)
+
+	// the revocation deletes the user and its permissions
+	fakeSaveLoad(resp.Secret)
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if resp != nil && resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+	if m.userExists(username) || m.isGroupMember("PerfView", username) {
+		t.Fatal("expected the user to be deleted")
+	}
+	equal(t, 0, len(testUserRootRoles(t, b, s, username)))
+}
+
+func TestSPReadCleanup(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	m := useMockProvider(b)
+
+	testRoleCreate(t, b, s, "missing-role", map[string]interface{}{
+		"vsphere_roles": "NoSuchRole",
+	})
+
+	// the permission can not be granted: the user is deleted right away
+	testSPReadError(t, b, s, "missing-role")
+	equal(t, 0, m.userCount())
+	testWALCount(t, s, 0)
+
+	// the user can not be deleted either: the WAL is kept for the rollback
+	m.setDeleteUserErr(errors.New("SSO admin service unavailable"))
+	testSPReadError(t, b, s, "missing-role")
+	equal(t, 1, m.userCount())
+	testWALCount(t, s, 1)
+}
+
+func TestMultipleRolesRejected(t *testing.T) {
+	b, s := getTestBackend(t, false)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "roles/multiple",
+		Data:      map[string]interface{}{"vsphere_roles": "Admin,ReadOnly"},
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if !resp.IsError() {
+		t.Fatal("expected a response error")
+	}
+
+	// the version 1 of the schema accepted them: the role is neither migrated nor used
+	ctx := context.Background()
+	entry, err := logical.StorageEntryJSON(rolesStoragePath+"/legacy", map[string]interface{}{
+		"username":      "vault-???",
+		"vsphere_roles": []string{"Admin", "ReadOnly"},
+	})
+	nilErr(t, err)
+	nilErr(t, s.Put(ctx, entry))
+
+	resp = testRequest(t, b, s, logical.UpdateOperation, "roles-migrate", nil)
+	if _, ok := resp.Data["failed"].(map[string]string)["legacy"]; !ok {
+		t.Fatalf("expected the migration of the role to fail, got %v", resp.Data)
+	}
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "session/legacy",
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if !resp.IsError() || !strings.Contains(resp.Error().Error(), "a single vSphere role can be granted on '/'") {
+		t.Fatalf("expected the credentials request to be rejected, got %v", resp)
+	}
+}
+
+func TestSPReadFolders(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	_ = useMockProvider(b)
+	ctx := context.Background()
+
+	testRoleCreate(t, b, s, "folders", map[string]interface{}{
+		"vsphere_roles": `[{"role_name":"ReadOnly","folders":["DC0/vm"]},{"role_name":"Admin","folders":["/DC0/host/"]}]`,
+	})
+	resp := testRequest(t, b, s, logical.ReadOperation, "roles/folders", nil)
+	equal(t, []*vsphereRole{
+		{RoleName: "ReadOnly", Folders: []string{"/DC0/vm"}},
+		{RoleName: "Admin", Folders: []string{"/DC0/host"}},
+	}, resp.Data["vsphere_roles"])
+
+	resp = testRequest(t, b, s, logical.ReadOperation, "session/folders", nil)
+	username := resp.Data["username"].(string)
+
+	client, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	dc, err := find.NewFinder(client.provider.GetMountGovmomiClient().Client).Datacenter(ctx, "DC0")
+	nilErr(t, err)
+	folders, err := dc.Folders(ctx)
+	nilErr(t, err)
+	equal(t, []string{"ReadOnly"}, testUserEntityRoles(t, b, s, username, folders.VmFolder.Reference()))
+	equal(t, []string{"Admin"}, testUserEntityRoles(t, b, s, username, folders.HostFolder.Reference()))
+	equal(t, 0, len(testUserRootRoles(t, b, s, username)))
+
+	// the inventory paths are resolved when the credentials are requested
+	testRoleCreate(t, b, s, "missing-folder", map[string]interface{}{
+		"vsphere_roles": `{"role_name":"ReadOnly","folders":["DC0/vm/missing"]}`,
+	})
+	testSPReadError(t, b, s, "missing-folder")
+
+	for _, invalid := range []string{
+		`[{"role_name":"ReadOnly","folder":["DC0/vm"]}]`,
+		`[{"folders":["DC0/vm"]}]`,
+		`[{"role_name":"ReadOnly","folders":["DC0/vm"]},{"role_name":"Admin","folders":["DC0/vm/"]}]`,
+	} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "roles/invalid",
+			Data:      map[string]interface{}{"vsphere_roles": invalid},
+			Storage:   s,
+		})
+		nilErr(t, err)
+		if !resp.IsError() {
+			t.Fatalf("expected %s to be rejected", invalid)
+		}
+	}
+}
+
+func TestSPReadTags(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	_ = useMockProvider(b)
+	ctx := context.Background()
+
+	client, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	vc := client.provider.GetMountGovmomiClient()
+	rc := client.settings.newRestClient(vc.Client)
+	nilErr(t, rc.Login(ctx, url.UserPassword(govmomitest.SimulatorServerSudoerUsername, govmomitest.SimulatorServerSudoerPassword)))
+	tm := tags.NewManager(rc)
+	categoryID, err := tm.CreateCategory(ctx, &tags.Category{Name: "tenant", Cardinality: "SINGLE", AssociableTypes: []string{"VirtualMachine"}})
+	nilErr(t, err)
+	tagID, err := tm.CreateTag(ctx, &tags.Tag{Name: "tenant1", CategoryID: categoryID})
+	nilErr(t, err)
+
+	finder := find.NewFinder(vc.Client)
+	vm, err := finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	nilErr(t, err)
+	other, err := finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM1")
+	nilErr(t, err)
+	nilErr(t, tm.AttachTag(ctx, tagID, vm.Reference()))
+
+	testRoleCreate(t, b, s, "tagged", map[string]interface{}{
+		"vsphere_roles": `{"role_name":"ReadOnly","tags":[{"category":"tenant","tag":"tenant1"}]}`,
+	})
+	resp := testRequest(t, b, s, logical.ReadOperation, "session/tagged", nil)
+	username := resp.Data["username"].(string)
+	equal(t, []string{"ReadOnly"}, testUserEntityRoles(t, b, s, username, vm.Reference()))
+	equal(t, 0, len(testUserEntityRoles(t, b, s, username, other.Reference())))
+	equal(t, 0, len(testUserRootRoles(t, b, s, username)))
+
+	// the objects granted are recorded in the lease and revoked even when the tags changed
+	nilErr(t, tm.DetachTag(ctx, tagID, vm.Reference()))
+	nilErr(t, tm.AttachTag(ctx, tagID, other.Reference()))
+	fakeSaveLoad(resp.Secret)
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if resp != nil && resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+	equal(t, 0, len(testUserEntityRoles(t, b, s, username, vm.Reference())))
+
+	testRoleCreate(t, b, s, "missing-tag", map[string]interface{}{
+		"vsphere_roles": `{"role_name":"ReadOnly","tags":[{"category":"tenant","tag":"missing"}]}`,
+	})
+	testSPReadError(t, b, s, "missing-tag")
+
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "roles/invalid",
+		Data:      map[string]interface{}{"vsphere_roles": `{"role_name":"ReadOnly","tags":[{"tag":"tenant1"}]}`},
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if !resp.IsError() {
+		t.Fatal("expected a tag without a category to be rejected")
+	}
+}
+
+func TestSPReadTarget(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
 
-	// if client.provider.(*mockProvider).passwordExists(keyID) {
-	// 	t.Fatalf("password present but should have been deleted")
-	// }
+	b, s := getTestBackend(t, false)
+	_ = useMockProvider(b)
+	ctx := context.Background()
+
+	testRoleCreate(t, b, s, "team", map[string]interface{}{
+		"vsphere_roles":   "ReadOnly",
+		"allowed_targets": "DC0/vm/*",
+	})
+	resp := testRequest(t, b, s, logical.ReadOperation, "roles/team", nil)
+	equal(t, []string{"/DC0/vm/*"}, resp.Data["allowed_targets"])
+
+	resp = testRequest(t, b, s, logical.ReadOperation, "session/team", map[string]interface{}{"target": "DC0/vm/DC0_H0_VM0"})
+	equal(t, "/DC0/vm/DC0_H0_VM0", resp.Data["target"])
+	equal(t, "/DC0/vm/DC0_H0_VM0", resp.Secret.InternalData["target"])
+	username := resp.Data["username"].(string)
+
+	client, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	vm, err := find.NewFinder(client.provider.GetMountGovmomiClient().Client).VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	nilErr(t, err)
+	equal(t, []string{"ReadOnly"}, testUserEntityRoles(t, b, s, username, vm.Reference()))
+	equal(t, 0, len(testUserRootRoles(t, b, s, username)))
+
+	testRoleCreate(t, b, s, "untargeted", map[string]interface{}{"vsphere_roles": "ReadOnly"})
+	for _, request := range []struct {
+		role   string
+		target string
+	}{
+		{"team", ""},
+		{"team", "DC0/host/DC0_H0"},
+		{"team", "DC0/vm/DC0_H0_VM0/nested"},
+		{"untargeted", "DC0/vm/DC0_H0_VM0"},
+	} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "session/" + request.role,
+			Data:      map[string]interface{}{"target": request.target},
+			Storage:   s,
+		})
+		nilErr(t, err)
+		if !resp.IsError() {
+			t.Fatalf("expected the target '%s' of role '%s' to be rejected", request.target, request.role)
+		}
+	}
+
+	for _, data := range []map[string]interface{}{
+		{"vsphere_roles": "ReadOnly", "allowed_targets": "DC0/vm/["},
+		{"vsphere_roles": "ReadOnly,Admin", "allowed_targets": "DC0/vm/*"},
+		{"vsphere_roles": `{"role_name":"ReadOnly","folders":["DC0/vm"]}`, "allowed_targets": "DC0/vm/*"},
+		{"username": "root", "password": "root", "allowed_targets": "DC0/vm/*"},
+	} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "roles/invalid",
+			Data:      data,
+			Storage:   s,
+		})
+		nilErr(t, err)
+		if !resp.IsError() {
+			t.Fatalf("expected %v to be rejected", data)
+		}
+	}
+}
+
+func testSPReadError(t *testing.T, b *vsphereSecretBackend, s logical.Storage, role string) {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "session/" + role,
+		Storage:   s,
+	})
+	if err == nil && !resp.IsError() {
+		t.Fatal("expected the credentials request to fail")
+	}
+}
+
+// testUserRootRoles returns the names of the vSphere roles granted to a SSO user on the root folder.
+func testUserRootRoles(t *testing.T, b *vsphereSecretBackend, s logical.Storage, username string) []string {
+	t.Helper()
+	client, err := b.getClient(context.Background(), s)
+	nilErr(t, err)
+	return testUserEntityRoles(t, b, s, username, client.provider.GetMountGovmomiClient().ServiceContent.RootFolder)
+}
+
+// testUserEntityRoles returns the names of the vSphere roles granted to a SSO user on an entity.
+func testUserEntityRoles(t *testing.T, b *vsphereSecretBackend, s logical.Storage, username string, entity types.ManagedObjectReference) []string {
+	t.Helper()
+	ctx := context.Background()
+	client, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	c := client.provider.GetMountGovmomiClient()
+
+	m := object.NewAuthorizationManager(c.Client)
+	roles, err := m.RoleList(ctx)
+	nilErr(t, err)
+	permissions, err := m.RetrieveEntityPermissions(ctx, entity, false)
+	nilErr(t, err)
+
+	var names []string
+	for _, p := range permissions {
+		if strings.HasSuffix(p.Principal, `\`+username) {
+			names = append(names, roles.ById(p.RoleId).Name)
+		}
+	}
+	return names
 }
@@ -0,0 +1,359 @@
+package vspheresecrets
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+const (
+	defaultSolutionCertificateTTL = 365 * 24 * time.Hour
+	defaultSolutionRotateBefore   = 30 * 24 * time.Hour
+)
+
+// solutionUserConfig describes the solution user registered and rotated by the plugin.
+// Its certificate and private key are stored in the Certificate and PrivateKey of the config.
+type solutionUserConfig struct {
+	Name           string        `json:"name"`
+	Groups         []string      `json:"groups,omitempty"`
+	CertificateTTL time.Duration `json:"certificate_ttl"`
+	RotateBefore   time.Duration `json:"rotate_before"`
+}
+
+func pathSolutionUser(b *vsphereSecretBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "config/solution-user",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the solution user to register. Required when registering.",
+				},
+				"groups": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: "Comma separated list of SSO groups the solution user is a member of. For example: ActAsUsers,Administrators",
+				},
+				"certificate_ttl": {
+					Type:        framework.TypeDurationSecond,
+					Description: "Validity of the generated certificates. Defaults to 1 year.",
+				},
+				"rotate_before": {
+					Type:        framework.TypeDurationSecond,
+					Description: "The certificate is rotated when it expires in less than this duration. Defaults to 30 days.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathSolutionUserRead,
+				logical.CreateOperation: b.pathSolutionUserWrite,
+				logical.UpdateOperation: b.pathSolutionUserWrite,
+				logical.DeleteOperation: b.pathSolutionUserDelete,
+			},
+			ExistenceCheck:  b.pathSolutionUserExistenceCheck,
+			HelpSynopsis:    solutionUserHelpSyn,
+			HelpDescription: solutionUserHelpDesc,
+		},
+		{
+			Pattern: "config/solution-user/rotate",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.pathSolutionUserRotate,
+			},
+			HelpSynopsis:    solutionUserRotateHelpSyn,
+			HelpDescription: solutionUserRotateHelpDesc,
+		},
+	}
+}
+
+// pathSolutionUserWrite registers the solution user with the current admin credentials
+// or updates the settings of the solution user already registered.
+func (b *vsphereSecretBackend) pathSolutionUserWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.solutionUserLock.Lock()
+	defer b.solutionUserLock.Unlock()
+
+	config, err := b.getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return logical.ErrorResponse("the mount must be configured before registering a solution user"), nil
+	}
+
+	solutionUser := config.SolutionUser
+	registered := solutionUser != nil
+	if !registered {
+		solutionUser = &solutionUserConfig{
+			CertificateTTL: defaultSolutionCertificateTTL,
+			RotateBefore:   defaultSolutionRotateBefore,
+		}
+	}
+
+	if name, ok := d.GetOk("name"); ok {
+		if registered && name.(string) != solutionUser.Name {
+			return logical.ErrorResponse("the name of a registered solution user cannot be changed"), nil
+		}
+		solutionUser.Name = name.(string)
+	}
+	if solutionUser.Name == "" {
+		return logical.ErrorResponse("name is required"), nil
+	}
+
+	previousGroups := solutionUser.Groups
+	if groups, ok := d.GetOk("groups"); ok {
+		solutionUser.Groups = strutil.RemoveDuplicates(groups.([]string), false)
+	}
+	if ttl, ok := d.GetOk("certificate_ttl"); ok {
+		solutionUser.CertificateTTL = time.Duration(ttl.(int)) * time.Second
+	}
+	if rotateBefore, ok := d.GetOk("rotate_before"); ok {
+		solutionUser.RotateBefore = time.Duration(rotateBefore.(int)) * time.Second
+	}
+	if solutionUser.CertificateTTL <= 0 {
+		return logical.ErrorResponse("certificate_ttl must be positive"), nil
+	}
+	if solutionUser.RotateBefore >= solutionUser.CertificateTTL {
+		return logical.ErrorResponse("rotate_before must be less than certificate_ttl"), nil
+	}
+
+	client, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if registered {
+		added := strutil.Difference(solutionUser.Groups, previousGroups, false)
+		removed := strutil.Difference(previousGroups, solutionUser.Groups, false)
+		if len(added) != 0 || len(removed) != 0 {
+			if err := client.provider.UpdateSolutionUserGroups(ctx, solutionUser.Name, added, removed); err != nil {
+				return nil, errwrap.Wrapf("error updating the solution user groups: {{err}}", err)
+			}
+		}
+		config.SolutionUser = solutionUser
+		return nil, b.saveConfig(ctx, config, req.Storage)
+	}
+
+	certPEM, keyPEM, der, err := generateSolutionCertificate(solutionUser.Name, solutionUser.CertificateTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := client.provider.CreateSolutionUser(ctx, solutionUser.Name, der, solutionUser.Groups); err != nil {
+		return nil, errwrap.Wrapf("error registering the solution user: {{err}}", err)
+	}
+
+	config.SolutionUser = solutionUser
+	config.Certificate = certPEM
+	config.PrivateKey = keyPEM
+	if err := b.saveConfig(ctx, config, req.Storage); err != nil {
+		if derr := client.provider.DeleteSolutionUser(ctx, solutionUser.Name); derr != nil {
+			b.Logger().Warn("error unregistering the solution user", "name", solutionUser.Name, "error", derr)
+		}
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+func (b *vsphereSecretBackend) pathSolutionUserRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	config, err := b.getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil || config.SolutionUser == nil {
+		return nil, nil
+	}
+
+	cert, err := parseSolutionCertificate(config.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	solutionUser := config.SolutionUser
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"name":            solutionUser.Name,
+			"groups":          solutionUser.Groups,
+			"certificate_ttl": int64(solutionUser.CertificateTTL / time.Second),
+			"rotate_before":   int64(solutionUser.RotateBefore / time.Second),
+			"certificate":     config.Certificate,
+			"thumbprint":      soap.ThumbprintSHA1(cert),
+			"expiration":      cert.NotAfter.Format(time.RFC3339),
+		},
+	}, nil
+}
+
+// pathSolutionUserDelete unregisters the solution user and removes its certificate from the config.
+func (b *vsphereSecretBackend) pathSolutionUserDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.solutionUserLock.Lock()
+	defer b.solutionUserLock.Unlock()
+
+	config, err := b.getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil || config.SolutionUser == nil {
+		return nil, nil
+	}
+
+	client, err := b.getClient(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.provider.DeleteSolutionUser(ctx, config.SolutionUser.Name); err != nil {
+		return nil, errwrap.Wrapf("error unregistering the solution user: {{err}}", err)
+	}
+
+	config.SolutionUser = nil
+	config.Certificate = ""
+	config.PrivateKey = ""
+	return nil, b.saveConfig(ctx, config, req.Storage)
+}
+
+func (b *vsphereSecretBackend) pathSolutionUserExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
+	config, err := b.getConfig(ctx, req.Storage)
+	if err != nil {
+		return false, err
+	}
+	return config != nil && config.SolutionUser != nil, nil
+}
+
+func (b *vsphereSecretBackend) pathSolutionUserRotate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.solutionUserLock.Lock()
+	defer b.solutionUserLock.Unlock()
+
+	config, err := b.getConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil || config.SolutionUser == nil {
+		return logical.ErrorResponse("no solution user is registered"), nil
+	}
+
+	return nil, b.rotateSolutionUser(ctx, req.Storage, config)
+}
+
+// rotateSolutionUserIfNeeded rotates the certificate of the registered solution user
+// when it expires in less than its rotate_before duration.
+func (b *vsphereSecretBackend) rotateSolutionUserIfNeeded(ctx context.Context, s logical.Storage) error {
+	b.solutionUserLock.Lock()
+	defer b.solutionUserLock.Unlock()
+
+	config, err := b.getConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	if config == nil || config.SolutionUser == nil {
+		return nil
+	}
+
+	cert, err := parseSolutionCertificate(config.Certificate)
+	if err != nil {
+		return err
+	}
+	if time.Now().Add(config.SolutionUser.RotateBefore).Before(cert.NotAfter) {
+		return nil
+	}
+
+	return b.rotateSolutionUser(ctx, s, config)
+}
+
+// rotateSolutionUser replaces the certificate of the solution user in a single update.
+// If the new certificate cannot be stored, the previous one is registered again.
+func (b *vsphereSecretBackend) rotateSolutionUser(ctx context.Context, s logical.Storage, config *vsphereConfig) error {
+	previous, err := parseSolutionCertificate(config.Certificate)
+	if err != nil {
+		return err
+	}
+
+	client, err := b.getClient(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	name := config.SolutionUser.Name
+	certPEM, keyPEM, der, err := generateSolutionCertificate(name, config.SolutionUser.CertificateTTL)
+	if err != nil {
+		return err
+	}
+
+	if err := client.provider.UpdateSolutionUser(ctx, name, der); err != nil {
+		return errwrap.Wrapf("error rotating the solution user certificate: {{err}}", err)
+	}
+
+	config.Certificate = certPEM
+	config.PrivateKey = keyPEM
+	if err := b.saveConfig(ctx, config, s); err != nil {
+		if rerr := client.provider.UpdateSolutionUser(ctx, name, previous.Raw); rerr != nil {
+			b.Logger().Error("error restoring the previous solution user certificate", "name", name, "error", rerr)
+		}
+		return err
+	}
+
+	b.Logger().Info("rotated the solution user certificate", "name", name)
+	return nil
+}
+
+// generateSolutionCertificate creates a private key and a self-signed certificate for a solution user.
+// It returns the PEM encoded certificate and key along with the DER encoded certificate.
+func generateSolutionCertificate(name string, ttl time.Duration) (string, string, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(ttl),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return string(certPEM), string(keyPEM), der, nil
+}
+
+func parseSolutionCertificate(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, errors.New("no PEM encoded solution certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+const solutionUserHelpSyn = `Register a solution user managed by the vSphere Secret backend.`
+const solutionUserHelpDesc = `
+This endpoint generates a private key and a self-signed certificate, registers a solution user
+for that certificate with the SSO admin service using the current credentials of the mount and
+adds it to the configured groups. The certificate and private key are stored in the config and
+the solution user becomes the identity of the mount.
+
+The certificate is rotated automatically before it expires.
+`
+
+const solutionUserRotateHelpSyn = `Rotate the certificate of the solution user.`
+const solutionUserRotateHelpDesc = `
+This endpoint generates a new private key and certificate and updates the registered solution user with it.
+`
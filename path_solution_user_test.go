@@ -0,0 +1,145 @@
+package vspheresecrets
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+)
+
+func TestSolutionUser(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, true)
+	m := useMockProvider(b)
+	ctx := context.Background()
+
+	testSolutionUserWrite(t, b, s, logical.CreateOperation, map[string]interface{}{
+		"name":            "vault-solution",
+		"groups":          "ActAsUsers,Administrators",
+		"certificate_ttl": 7200,
+		"rotate_before":   3600,
+	})
+
+	config, err := b.getConfig(ctx, s)
+	nilErr(t, err)
+	cert, err := parseSolutionCertificate(config.Certificate)
+	nilErr(t, err)
+	if !bytes.Equal(cert.Raw, m.solutionUserCertificate("vault-solution")) {
+		t.Fatal("expected the stored certificate to be registered")
+	}
+	if !m.isGroupMember("ActAsUsers", "vault-solution") || !m.isGroupMember("Administrators", "vault-solution") {
+		t.Fatal("expected the solution user to be a member of its groups")
+	}
+
+	// the mount is now logged in as the solution user
+	client, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	if client.settings.SolutionCertificate == nil {
+		t.Fatal("expected the mount to use the solution certificate")
+	}
+	testListDatacenters(t, client.provider.GetMountGovmomiClient())
+
+	resp, err := b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "config/solution-user",
+		Storage:   s,
+	})
+	nilErr(t, err)
+	equal(t, "vault-solution", resp.Data["name"])
+	equal(t, []string{"ActAsUsers", "Administrators"}, resp.Data["groups"])
+	if _, ok := resp.Data["private_key"]; ok {
+		t.Fatal("the private key must not be returned")
+	}
+
+	t.Run("Groups", func(t *testing.T) {
+		testSolutionUserWrite(t, b, s, logical.UpdateOperation, map[string]interface{}{
+			"groups": "ActAsUsers",
+		})
+		if m.isGroupMember("Administrators", "vault-solution") {
+			t.Fatal("expected the solution user to be removed from Administrators")
+		}
+	})
+
+	t.Run("PeriodicRotation", func(t *testing.T) {
+		// not due yet
+		_, err := b.HandleRequest(ctx, &logical.Request{Operation: logical.RollbackOperation, Storage: s})
+		nilErr(t, err)
+		if !bytes.Equal(cert.Raw, m.solutionUserCertificate("vault-solution")) {
+			t.Fatal("the certificate must not be rotated before it is due")
+		}
+
+		testSolutionUserWrite(t, b, s, logical.UpdateOperation, map[string]interface{}{
+			"certificate_ttl": 86400,
+			"rotate_before":   10000,
+		})
+		_, err = b.HandleRequest(ctx, &logical.Request{Operation: logical.RollbackOperation, Storage: s})
+		nilErr(t, err)
+
+		config, err := b.getConfig(ctx, s)
+		nilErr(t, err)
+		rotated, err := parseSolutionCertificate(config.Certificate)
+		nilErr(t, err)
+		if bytes.Equal(cert.Raw, rotated.Raw) {
+			t.Fatal("expected the certificate to be rotated")
+		}
+		if !bytes.Equal(rotated.Raw, m.solutionUserCertificate("vault-solution")) {
+			t.Fatal("expected the rotated certificate to be registered")
+		}
+		cert = rotated
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		testSolutionUserWrite(t, b, s, logical.UpdateOperation, nil, "config/solution-user/rotate")
+
+		config, err := b.getConfig(ctx, s)
+		nilErr(t, err)
+		rotated, err := parseSolutionCertificate(config.Certificate)
+		nilErr(t, err)
+		if bytes.Equal(cert.Raw, rotated.Raw) || !bytes.Equal(rotated.Raw, m.solutionUserCertificate("vault-solution")) {
+			t.Fatal("expected the certificate to be rotated and registered")
+		}
+
+		client, err := b.getClient(ctx, s)
+		nilErr(t, err)
+		testListDatacenters(t, client.provider.GetMountGovmomiClient())
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		_, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "config/solution-user",
+			Storage:   s,
+		})
+		nilErr(t, err)
+		if m.solutionUserCertificate("vault-solution") != nil {
+			t.Fatal("expected the solution user to be unregistered")
+		}
+		config, err := b.getConfig(ctx, s)
+		nilErr(t, err)
+		if config.SolutionUser != nil || config.Certificate != "" || config.PrivateKey != "" {
+			t.Fatal("expected the solution certificate to be removed from the config")
+		}
+	})
+}
+
+func testSolutionUserWrite(t *testing.T, b *vsphereSecretBackend, s logical.Storage, op logical.Operation, d map[string]interface{}, path ...string) {
+	t.Helper()
+	p := "config/solution-user"
+	if len(path) != 0 {
+		p = path[0]
+	}
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: op,
+		Path:      p,
+		Data:      d,
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if resp != nil && resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+}
@@ -0,0 +1,333 @@
+package vspheresecrets
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// defaultTidySafetyAge protects the users that are still being created.
+	defaultTidySafetyAge = time.Hour
+	// tidyInterval is the interval of the periodic tidy.
+	tidyInterval = time.Hour
+)
+
+// tidyResult lists the orphaned users and permissions of a connection.
+type tidyResult struct {
+	// Users are created by the mount and covered by no lease.
+	Users []string
+	// Permissions are granted to users that no longer exist and match the username of a dynamic role.
+	Permissions []map[string]string
+	// Skipped are orphaned users younger than the safety age.
+	Skipped []string
+}
+
+func pathTidy(b *vsphereSecretBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "tidy$",
+		Fields: map[string]*framework.FieldSchema{
+			"connection": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the vCenter connection to tidy. When empty, the default connection is tidied.",
+			},
+			"dry_run": {
+				Type:        framework.TypeBool,
+				Description: "When true, the orphaned users and permissions are only reported.",
+			},
+			"safety_age": {
+				Type:        framework.TypeDurationSecond,
+				Description: "Users created more recently are not deleted, as they may still be in the process of being created. Defaults to 1h.",
+				Default:     int(defaultTidySafetyAge / time.Second),
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathTidyWrite,
+		},
+		HelpSynopsis:    tidyHelpSyn,
+		HelpDescription: tidyHelpDesc,
+	}
+}
+
+func (b *vsphereSecretBackend) pathTidyWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	connection := d.Get("connection").(string)
+	dryRun := d.Get("dry_run").(bool)
+	safetyAge := time.Duration(d.Get("safety_age").(int)) * time.Second
+	if safetyAge < 0 {
+		return logical.ErrorResponse("safety_age must not be negative"), nil
+	}
+
+	if !atomic.CompareAndSwapUint32(&b.tidyRunning, 0, 1) {
+		return logical.ErrorResponse("a tidy operation is already running"), nil
+	}
+	defer atomic.StoreUint32(&b.tidyRunning, 0)
+
+	result, err := b.tidyConnection(ctx, req.Storage, connection, dryRun, safetyAge)
+	if result == nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"dry_run":          dryRun,
+			"users":            result.Users,
+			"user_count":       len(result.Users),
+			"permissions":      result.Permissions,
+			"permission_count": len(result.Permissions),
+			"skipped":          result.Skipped,
+		},
+	}
+	if err != nil {
+		resp.AddWarning(err.Error())
+	}
+	return resp, nil
+}
+
+// periodicTidy deletes the orphaned users and permissions of the connections of the dynamic roles.
+func (b *vsphereSecretBackend) periodicTidy(ctx context.Context, s logical.Storage) error {
+	if !atomic.CompareAndSwapUint32(&b.tidyRunning, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreUint32(&b.tidyRunning, 0)
+	if time.Since(b.lastTidy) < tidyInterval {
+		return nil
+	}
+	b.lastTidy = time.Now()
+
+	connections, err := dynamicRoleConnections(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	var merr *multierror.Error
+	for _, connection := range connections {
+		result, err := b.tidyConnection(ctx, s, connection, false, defaultTidySafetyAge)
+		if err != nil {
+			merr = multierror.Append(merr, errwrap.Wrapf(fmt.Sprintf("error tidying connection '%s': {{err}}", connection), err))
+		}
+		if result != nil && (len(result.Users) != 0 || len(result.Permissions) != 0) {
+			b.Logger().Info("deleted orphaned vSphere principals", "connection", connection,
+				"users", result.Users, "permissions", len(result.Permissions))
+		}
+	}
+	return merr.ErrorOrNil()
+}
+
+// tidyConnection finds the users created by the mount that no live lease or WAL covers, and the permissions
+// of the users that no longer exist and match the username of a dynamic role. They are deleted unless dryRun is set.
+// The result lists what was found even when the deletion of some of them failed.
+func (b *vsphereSecretBackend) tidyConnection(ctx context.Context, s logical.Storage, connection string, dryRun bool, safetyAge time.Duration) (*tidyResult, error) {
+	c, err := b.getConnectionClient(ctx, s, connection)
+	if err != nil {
+		return nil, err
+	}
+	mountID, err := b.mountID(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	live, err := liveUsernames(ctx, s, connection)
+	if err != nil {
+		return nil, err
+	}
+	prefixes, err := dynamicRoleUsernamePrefixes(ctx, s, connection)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := c.provider.ListUsers(ctx)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing the users: {{err}}", err)
+	}
+	permissions, err := c.provider.ListUserPermissions(ctx)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing the permissions: {{err}}", err)
+	}
+
+	result := new(tidyResult)
+	existing := make(map[string]bool)
+	var orphans []*dynamicUser
+	for _, user := range users {
+		existing[user.Name] = true
+		createdAt, ok := parseManagedUserDescription(mountID, user.Description)
+		if !ok || live[user.Name] {
+			continue
+		}
+		if time.Since(createdAt) < safetyAge {
+			result.Skipped = append(result.Skipped, user.Name)
+			continue
+		}
+		result.Users = append(result.Users, user.Name)
+		orphans = append(orphans, &dynamicUser{
+			Connection:  connection,
+			Username:    user.Name,
+			Permissions: permissions[user.Name],
+		})
+	}
+
+	names := make([]string, 0, len(permissions))
+	for name := range permissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var orphanedPermissions []*dynamicUser
+	for _, name := range names {
+		userPermissions := permissions[name]
+		if existing[name] || live[name] || !hasAnyPrefix(name, prefixes) {
+			continue
+		}
+		exists, err := c.provider.UserExists(ctx, name)
+		if err != nil {
+			return nil, errwrap.Wrapf("error looking up the user: {{err}}", err)
+		}
+		if exists {
+			continue
+		}
+		for _, p := range userPermissions {
+			result.Permissions = append(result.Permissions, map[string]string{
+				"principal": name,
+				"entity":    p.Entity,
+				"role":      p.Role,
+			})
+		}
+		orphanedPermissions = append(orphanedPermissions, &dynamicUser{Username: name, Permissions: userPermissions})
+	}
+
+	if dryRun {
+		return result, nil
+	}
+
+	var merr *multierror.Error
+	for _, user := range orphans {
+		if err := c.deleteUser(ctx, user); err != nil {
+			merr = multierror.Append(merr, errwrap.Wrapf(fmt.Sprintf("error deleting '%s': {{err}}", user.Username), err))
+		}
+	}
+	for _, user := range orphanedPermissions {
+		if err := c.provider.RevokePermissions(ctx, user.Username, user.Permissions); err != nil {
+			merr = multierror.Append(merr, errwrap.Wrapf(fmt.Sprintf("error revoking the permissions of '%s': {{err}}", user.Username), err))
+		}
+	}
+	return result, merr.ErrorOrNil()
+}
+
+// liveUsernames returns the usernames of a connection that are covered by a lease or
+// are being created or rolled back by a WAL.
+func liveUsernames(ctx context.Context, s logical.Storage, connection string) (map[string]bool, error) {
+	live := make(map[string]bool)
+
+	principals, err := listPrincipals(ctx, s)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing the principals: {{err}}", err)
+	}
+	for _, p := range principals {
+		if p.Connection == connection {
+			live[p.Username] = true
+		}
+	}
+
+	walIDs, err := framework.ListWAL(ctx, s)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing WAL: {{err}}", err)
+	}
+	for _, walID := range walIDs {
+		entry, err := framework.GetWAL(ctx, s, walID)
+		if err != nil {
+			return nil, errwrap.Wrapf("error reading WAL: {{err}}", err)
+		}
+		if entry == nil || entry.Kind != walUserKind {
+			continue
+		}
+		var user walUser
+		if err := decodeJSON(entry.Data, &user); err != nil {
+			return nil, err
+		}
+		if user.Connection == connection {
+			live[user.Username] = true
+		}
+	}
+	return live, nil
+}
+
+// dynamicRoleConnections returns the connections of the roles that create dynamic users.
+func dynamicRoleConnections(ctx context.Context, s logical.Storage) ([]string, error) {
+	roles, err := s.List(ctx, rolesStoragePath+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing roles: {{err}}", err)
+	}
+
+	seen := make(map[string]bool)
+	var connections []string
+	for _, roleName := range roles {
+		role, err := getRole(ctx, roleName, s)
+		if err != nil {
+			return nil, errwrap.Wrapf("error reading role: {{err}}", err)
+		}
+		if role == nil || role.Password != "" || seen[role.Connection] {
+			continue
+		}
+		seen[role.Connection] = true
+		connections = append(connections, role.Connection)
+	}
+	return connections, nil
+}
+
+// dynamicRoleUsernamePrefixes returns the fixed prefixes of the usernames generated by the dynamic roles of a connection.
+func dynamicRoleUsernamePrefixes(ctx context.Context, s logical.Storage, connection string) ([]string, error) {
+	roles, err := s.List(ctx, rolesStoragePath+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing roles: {{err}}", err)
+	}
+
+	var prefixes []string
+	for _, roleName := range roles {
+		role, err := getRole(ctx, roleName, s)
+		if err != nil {
+			return nil, errwrap.Wrapf("error reading role: {{err}}", err)
+		}
+		if role == nil || role.Password != "" || role.Connection != connection {
+			continue
+		}
+		if prefix := usernamePrefix(role.Username); prefix != "" {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes, nil
+}
+
+// usernamePrefix returns the part of a username template before its first random character.
+func usernamePrefix(template string) string {
+	if i := strings.IndexByte(template, '?'); i >= 0 {
+		return template[:i]
+	}
+	return template
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+const tidyHelpSyn = `Delete the vSphere users and permissions that outlived their lease.`
+const tidyHelpDesc = `
+Each dynamic user is created with a description that identifies the mount. The users
+of the mount that no lease covers, such as the users of leases lost with a storage
+restore, are deleted with their permissions. The permissions of the users that no
+longer exist and match the username of a dynamic role are removed as well.
+
+The users created less than safety_age ago are skipped, and dry_run only reports what
+would be deleted. The tidy also runs every hour for the connections of the dynamic roles.
+`
@@ -0,0 +1,104 @@
+package vspheresecrets
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+	"github.com/vmware/govmomi/find"
+)
+
+func TestTidy(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	m := useMockProvider(b)
+	ctx := context.Background()
+
+	testRoleCreate(t, b, s, "dynamic", testDynamicSPRole)
+	resp := testRequest(t, b, s, logical.ReadOperation, "session/dynamic", nil)
+	leased := resp.Data["username"].(string)
+
+	client, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	mountID, err := b.mountID(ctx, s)
+	nilErr(t, err)
+
+	// the simulator replaces the permissions of an entity: each user is granted a role on its own entity
+	dc, err := find.NewFinder(client.provider.GetMountGovmomiClient().Client).DefaultDatacenter(ctx)
+	nilErr(t, err)
+	folders, err := dc.Folders(ctx)
+	nilErr(t, err)
+	orphan := &dynamicUser{
+		Username:    "vault-test-orphan",
+		Permissions: []vspherePermission{{Entity: folders.VmFolder.Reference().String(), Role: "ReadOnly"}},
+	}
+	nilErr(t, client.createUser(ctx, orphan, "Va1-password", managedUserDescription(mountID, time.Now().Add(-2*time.Hour))))
+	young := &dynamicUser{Username: "vault-test-young"}
+	nilErr(t, client.createUser(ctx, young, "Va1-password", managedUserDescription(mountID, time.Now())))
+	other := &dynamicUser{Username: "vault-test-other"}
+	nilErr(t, client.createUser(ctx, other, "Va1-password", managedUserDescription("other-mount", time.Now().Add(-2*time.Hour))))
+	gone := []vspherePermission{{Entity: folders.HostFolder.Reference().String(), Role: "ReadOnly"}}
+	nilErr(t, client.provider.GrantPermissions(ctx, "vault-test-gone", gone))
+
+	t.Run("DryRun", func(t *testing.T) {
+		resp := testRequest(t, b, s, logical.UpdateOperation, "tidy", map[string]interface{}{"dry_run": true})
+		equal(t, []string{orphan.Username}, resp.Data["users"])
+		equal(t, []string{young.Username}, resp.Data["skipped"])
+		equal(t, []map[string]string{{
+			"principal": "vault-test-gone",
+			"entity":    gone[0].Entity,
+			"role":      "ReadOnly",
+		}}, resp.Data["permissions"])
+		if !m.userExists(orphan.Username) {
+			t.Fatal("expected the dry run to delete nothing")
+		}
+	})
+
+	t.Run("Tidy", func(t *testing.T) {
+		resp := testRequest(t, b, s, logical.UpdateOperation, "tidy", nil)
+		equal(t, 1, resp.Data["user_count"])
+		equal(t, 1, resp.Data["permission_count"])
+
+		if m.userExists(orphan.Username) {
+			t.Fatal("expected the orphaned user to be deleted")
+		}
+		permissions, err := client.provider.ListUserPermissions(ctx)
+		nilErr(t, err)
+		equal(t, 0, len(permissions[orphan.Username]))
+		equal(t, 0, len(permissions["vault-test-gone"]))
+
+		// the users of the live leases, the recent users and the users of other mounts are kept
+		for _, username := range []string{leased, young.Username, other.Username} {
+			if !m.userExists(username) {
+				t.Fatalf("expected the user %s to be kept", username)
+			}
+		}
+		equal(t, []string{"ReadOnly"}, testUserRootRoles(t, b, s, leased))
+	})
+
+	t.Run("SafetyAge", func(t *testing.T) {
+		testRequest(t, b, s, logical.UpdateOperation, "tidy", map[string]interface{}{"safety_age": 0})
+		if m.userExists(young.Username) {
+			t.Fatal("expected the recent user to be deleted")
+		}
+	})
+
+	t.Run("Periodic", func(t *testing.T) {
+		nilErr(t, client.createUser(ctx, orphan, "Va1-password", managedUserDescription(mountID, time.Now().Add(-2*time.Hour))))
+		nilErr(t, b.periodicFunc(ctx, &logical.Request{Storage: s}))
+		if m.userExists(orphan.Username) {
+			t.Fatal("expected the periodic tidy to delete the orphaned user")
+		}
+
+		// the periodic tidy only runs once per interval
+		nilErr(t, client.createUser(ctx, orphan, "Va1-password", managedUserDescription(mountID, time.Now().Add(-2*time.Hour))))
+		nilErr(t, b.periodicFunc(ctx, &logical.Request{Storage: s}))
+		if !m.userExists(orphan.Username) {
+			t.Fatal("expected the periodic tidy to wait for the next interval")
+		}
+	})
+}
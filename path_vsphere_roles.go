@@ -0,0 +1,225 @@
+package vspheresecrets
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func pathPrivileges(b *vsphereSecretBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "privileges/?$",
+		Fields: map[string]*framework.FieldSchema{
+			"connection": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the connection. When empty, the default connection is used.",
+				Query:       true,
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathPrivilegesRead,
+		},
+		HelpSynopsis:    privilegesHelpSyn,
+		HelpDescription: privilegesHelpDesc,
+	}
+}
+
+func pathsVSphereRole(b *vsphereSecretBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "vsphere-roles/?$",
+			Fields: map[string]*framework.FieldSchema{
+				"connection": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the connection. When empty, the default connection is used.",
+					Query:       true,
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathVSphereRoleList,
+			},
+			HelpSynopsis:    vsphereRoleListHelpSyn,
+			HelpDescription: vsphereRoleListHelpDesc,
+		},
+		{
+			Pattern: "vsphere-roles/" + framework.MatchAllRegex("name"),
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeString,
+					Description: "Name of the vSphere role.",
+				},
+				"connection": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the connection. When empty, the default connection is used.",
+					Query:       true,
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathVSphereRoleRead,
+			},
+			HelpSynopsis:    vsphereRoleHelpSyn,
+			HelpDescription: vsphereRoleHelpDesc,
+		},
+	}
+}
+
+// pathPrivilegesRead lists the privileges defined by vCenter, by privilege group.
+func (b *vsphereSecretBackend) pathPrivilegesRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	client, err := b.getConnectionClient(ctx, req.Storage, d.Get("connection").(string))
+	if err != nil {
+		return nil, err
+	}
+	privileges, err := client.provider.ListPrivileges(ctx)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing the privileges: {{err}}", err)
+	}
+
+	groups := make(map[string][]map[string]interface{})
+	for _, p := range privileges {
+		groups[p.PrivGroupName] = append(groups[p.PrivGroupName], map[string]interface{}{
+			"id":        p.PrivId,
+			"name":      p.Name,
+			"on_parent": p.OnParent,
+		})
+	}
+	for _, group := range groups {
+		sort.Slice(group, func(i, j int) bool {
+			return group[i]["id"].(string) < group[j]["id"].(string)
+		})
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"groups":          groups,
+			"privilege_count": len(privileges),
+		},
+	}, nil
+}
+
+// pathVSphereRoleList lists the vSphere roles with their identifiers and privileges.
+func (b *vsphereSecretBackend) pathVSphereRoleList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	client, err := b.getConnectionClient(ctx, req.Storage, d.Get("connection").(string))
+	if err != nil {
+		return nil, err
+	}
+	roles, err := client.provider.ListRoles(ctx)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing the vSphere roles: {{err}}", err)
+	}
+
+	keys := make([]string, 0, len(roles))
+	keyInfo := make(map[string]interface{}, len(roles))
+	for _, role := range roles {
+		keys = append(keys, role.Name)
+		keyInfo[role.Name] = vsphereRoleData(role)
+	}
+	sort.Strings(keys)
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+// pathVSphereRoleRead returns a vSphere role with the Vault roles of the connection that grant it.
+func (b *vsphereSecretBackend) pathVSphereRoleRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+	connection := d.Get("connection").(string)
+
+	client, err := b.getConnectionClient(ctx, req.Storage, connection)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := client.provider.ListRoles(ctx)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing the vSphere roles: {{err}}", err)
+	}
+
+	var found *types.AuthorizationRole
+	for i := range roles {
+		if roles[i].Name == name {
+			found = &roles[i]
+			break
+		}
+	}
+	if found == nil {
+		return nil, nil
+	}
+
+	vaultRoles, err := vsphereRoleReferences(ctx, req.Storage, connection, name)
+	if err != nil {
+		return nil, err
+	}
+
+	data := vsphereRoleData(*found)
+	data["name"] = found.Name
+	data["vault_roles"] = vaultRoles
+	return &logical.Response{Data: data}, nil
+}
+
+func vsphereRoleData(role types.AuthorizationRole) map[string]interface{} {
+	privileges := append([]string{}, role.Privilege...)
+	sort.Strings(privileges)
+
+	data := map[string]interface{}{
+		"id":         role.RoleId,
+		"system":     role.System,
+		"privileges": privileges,
+	}
+	if role.Info != nil {
+		info := role.Info.GetDescription()
+		data["label"] = info.Label
+		data["summary"] = info.Summary
+	}
+	return data
+}
+
+// vsphereRoleReferences returns the names of the Vault roles of a connection that grant a vSphere role,
+// through their vsphere_roles or their privileges.
+func vsphereRoleReferences(ctx context.Context, s logical.Storage, connection, vsphereRole string) ([]string, error) {
+	names, err := s.List(ctx, rolesStoragePath+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing roles: {{err}}", err)
+	}
+
+	references := []string{}
+	for _, name := range names {
+		role, err := getRole(ctx, name, s)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("error reading role '%s': {{err}}", name), err)
+		}
+		if role == nil || role.Connection != connection {
+			continue
+		}
+		if role.PrivilegeRole == vsphereRole {
+			references = append(references, name)
+			continue
+		}
+		for _, r := range role.VSphereRoles {
+			if r.RoleName == vsphereRole {
+				references = append(references, name)
+				break
+			}
+		}
+	}
+	return references, nil
+}
+
+const privilegesHelpSyn = `List the vSphere privileges by privilege group.`
+const privilegesHelpDesc = `
+This endpoint lists the identifiers of the privileges defined by the vCenter of a connection,
+grouped by privilege group. They are the values accepted by the privileges of a role.
+`
+
+const vsphereRoleListHelpSyn = `List the vSphere roles.`
+const vsphereRoleListHelpDesc = `
+This endpoint lists the roles defined by the vCenter of a connection, with their identifiers
+and privileges. They are the values accepted by the vsphere_roles of a role.
+`
+
+const vsphereRoleHelpSyn = `Read a vSphere role and the Vault roles that grant it.`
+const vsphereRoleHelpDesc = `
+This endpoint returns the identifier and the privileges of a role defined by the vCenter of a
+connection, and the Vault roles of that connection that grant it to their dynamic users.
+`
@@ -0,0 +1,78 @@
+package vspheresecrets
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+)
+
+func TestPrivileges(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, true)
+	_ = useMockProvider(b)
+
+	resp := testRequest(t, b, s, logical.ReadOperation, "privileges/", nil)
+	groups := resp.Data["groups"].(map[string][]map[string]interface{})
+	found := false
+	for _, p := range groups["VirtualMachine.Interact"] {
+		if p["id"] == "VirtualMachine.Interact.PowerOn" {
+			equal(t, "PowerOn", p["name"])
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected VirtualMachine.Interact.PowerOn in its group, got %v", groups["VirtualMachine.Interact"])
+	}
+}
+
+func TestVSphereRoles(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, true)
+	_ = useMockProvider(b)
+
+	testRoleCreate(t, b, s, "readers", map[string]interface{}{"vsphere_roles": "ReadOnly"})
+	testRoleCreate(t, b, s, "power", map[string]interface{}{"privileges": "VirtualMachine.Interact.PowerOn"})
+	privilegeRole := testRequest(t, b, s, logical.ReadOperation, "roles/power", nil).Data["privilege_role"].(string)
+
+	t.Run("List", func(t *testing.T) {
+		resp := testRequest(t, b, s, logical.ListOperation, "vsphere-roles/", nil)
+		keys := resp.Data["keys"].([]string)
+		info := resp.Data["key_info"].(map[string]interface{})
+		for _, name := range []string{"Admin", "ReadOnly", privilegeRole} {
+			if info[name] == nil {
+				t.Fatalf("expected the role %s in %v", name, keys)
+			}
+		}
+		admin := info["Admin"].(map[string]interface{})
+		equal(t, true, admin["system"])
+		equal(t, int32(-1), admin["id"])
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		resp := testRequest(t, b, s, logical.ReadOperation, "vsphere-roles/ReadOnly", nil)
+		equal(t, []string{"readers"}, resp.Data["vault_roles"])
+
+		resp = testRequest(t, b, s, logical.ReadOperation, "vsphere-roles/"+privilegeRole, nil)
+		equal(t, []string{"power"}, resp.Data["vault_roles"])
+		found := false
+		for _, p := range resp.Data["privileges"].([]string) {
+			found = found || p == "VirtualMachine.Interact.PowerOn"
+		}
+		if !found {
+			t.Fatal("expected the privileges of the role")
+		}
+
+		resp = testRequest(t, b, s, logical.ReadOperation, "vsphere-roles/NoAccess", nil)
+		equal(t, []string{}, resp.Data["vault_roles"])
+
+		resp = testRequest(t, b, s, logical.ReadOperation, "vsphere-roles/NoSuchRole", nil)
+		if resp != nil {
+			t.Fatal("expected no role")
+		}
+	})
+}
@@ -0,0 +1,205 @@
+package vspheresecrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	// principalsStoragePath indexes the dynamic users of the live leases by role: principals/<role>/<username>.
+	principalsStoragePath = "principals/"
+	// sessionsStoragePath indexes the sessions of the live leases of the static roles: sessions/<role>/<id>.
+	sessionsStoragePath = "sessions/"
+	// mountIDStoragePath identifies the mount in the description of the users it creates.
+	mountIDStoragePath = "mount_id"
+
+	managedUserMarker = "Managed by the Vault vSphere secrets engine mount"
+)
+
+// principalEntry is the dynamic user of a live lease.
+type principalEntry struct {
+	dynamicUser
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func principalStorageKey(role, username string) string {
+	return principalsStoragePath + role + "/" + username
+}
+
+// savePrincipal indexes the dynamic user of a lease under its role.
+func savePrincipal(ctx context.Context, s logical.Storage, user *dynamicUser) error {
+	entry, err := logical.StorageEntryJSON(principalStorageKey(user.Role, user.Username), &principalEntry{
+		dynamicUser: *user,
+		CreatedAt:   time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// deletePrincipal removes the dynamic user of a lease from the index.
+func deletePrincipal(ctx context.Context, s logical.Storage, user *dynamicUser) error {
+	return s.Delete(ctx, principalStorageKey(user.Role, user.Username))
+}
+
+// listRolePrincipals returns the dynamic users of the live leases of a role.
+func listRolePrincipals(ctx context.Context, s logical.Storage, role string) ([]*principalEntry, error) {
+	keys, err := s.List(ctx, principalsStoragePath+role+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var principals []*principalEntry
+	for _, key := range keys {
+		entry, err := s.Get(ctx, principalStorageKey(role, key))
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		principal := new(principalEntry)
+		if err := entry.DecodeJSON(principal); err != nil {
+			return nil, err
+		}
+		principals = append(principals, principal)
+	}
+	return principals, nil
+}
+
+// listPrincipals returns the dynamic users of all the live leases.
+func listPrincipals(ctx context.Context, s logical.Storage) ([]*principalEntry, error) {
+	roles, err := s.List(ctx, principalsStoragePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var principals []*principalEntry
+	for _, role := range roles {
+		rolePrincipals, err := listRolePrincipals(ctx, s, strings.TrimSuffix(role, "/"))
+		if err != nil {
+			return nil, err
+		}
+		principals = append(principals, rolePrincipals...)
+	}
+	return principals, nil
+}
+
+// sessionEntry is the session of a live lease of a static role.
+type sessionEntry struct {
+	ID         string `json:"id"`
+	Role       string `json:"role"`
+	Connection string `json:"connection"`
+	// GovmomiClient is the serialized client logged in the session.
+	GovmomiClient interface{} `json:"govmomiclient"`
+	CreatedAt     time.Time   `json:"created_at"`
+}
+
+func sessionStorageKey(role, id string) string {
+	return sessionsStoragePath + role + "/" + id
+}
+
+// saveSession indexes the session of a lease under its role.
+func saveSession(ctx context.Context, s logical.Storage, session *sessionEntry) error {
+	entry, err := logical.StorageEntryJSON(sessionStorageKey(session.Role, session.ID), session)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+// deleteSession removes the session of a lease from the index.
+func deleteSession(ctx context.Context, s logical.Storage, role, id string) error {
+	return s.Delete(ctx, sessionStorageKey(role, id))
+}
+
+// listRoleSessions returns the sessions of the live leases of a role.
+func listRoleSessions(ctx context.Context, s logical.Storage, role string) ([]*sessionEntry, error) {
+	keys, err := s.List(ctx, sessionsStoragePath+role+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*sessionEntry
+	for _, key := range keys {
+		entry, err := s.Get(ctx, sessionStorageKey(role, key))
+		if err != nil {
+			return nil, err
+		}
+		if entry == nil {
+			continue
+		}
+		session := new(sessionEntry)
+		if err := entry.DecodeJSON(session); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// listSessions returns the sessions of all the live leases.
+func listSessions(ctx context.Context, s logical.Storage) ([]*sessionEntry, error) {
+	roles, err := s.List(ctx, sessionsStoragePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*sessionEntry
+	for _, role := range roles {
+		roleSessions, err := listRoleSessions(ctx, s, strings.TrimSuffix(role, "/"))
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, roleSessions...)
+	}
+	return sessions, nil
+}
+
+// mountID returns the random identifier of the mount, generated on first use.
+func (b *vsphereSecretBackend) mountID(ctx context.Context, s logical.Storage) (string, error) {
+	b.mountIDLock.Lock()
+	defer b.mountIDLock.Unlock()
+
+	entry, err := s.Get(ctx, mountIDStoragePath)
+	if err != nil {
+		return "", err
+	}
+	if entry != nil {
+		return string(entry.Value), nil
+	}
+
+	id, err := uuid.GenerateUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := s.Put(ctx, &logical.StorageEntry{Key: mountIDStoragePath, Value: []byte(id)}); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// managedUserDescription returns the description of a user created by the mount.
+func managedUserDescription(mountID string, createdAt time.Time) string {
+	return fmt.Sprintf("%s %s, created at %s", managedUserMarker, mountID, createdAt.UTC().Format(time.RFC3339))
+}
+
+// parseManagedUserDescription returns the creation time of a user created by the mount.
+// It returns false for the users created by other mounts or outside of Vault.
+func parseManagedUserDescription(mountID, description string) (time.Time, bool) {
+	prefix := fmt.Sprintf("%s %s, created at ", managedUserMarker, mountID)
+	if !strings.HasPrefix(description, prefix) {
+		return time.Time{}, false
+	}
+	createdAt, err := time.Parse(time.RFC3339, strings.TrimPrefix(description, prefix))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return createdAt, true
+}
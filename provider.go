@@ -3,11 +3,26 @@ package vspheresecrets
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
+	"fmt"
 	"net/url"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/go-hclog"
 	"github.com/vmware/govmomi"
+	ltypes "github.com/vmware/govmomi/lookup/types"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/ssoadmin"
+	ssotypes "github.com/vmware/govmomi/ssoadmin/types"
 	"github.com/vmware/govmomi/sts"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
 )
 
 // VSphereProvider is an interface to access underlying VSphere govmomi client objects and supporting services.
@@ -27,6 +42,70 @@ type VSphereProvider interface {
 	StartSession(ctx context.Context, toBeDefined map[string]interface{}) (string, error)
 	RenewSession(ctx context.Context, toBeDefined map[string]interface{}) error
 	RevokeSession(ctx context.Context, toBeDefined map[string]interface{}) error
+	// CreateSolutionUser registers a solution user for the DER encoded certificate and adds it to the groups
+	CreateSolutionUser(ctx context.Context, name string, certificate []byte, groups []string) error
+	// UpdateSolutionUser replaces the certificate of a solution user
+	UpdateSolutionUser(ctx context.Context, name string, certificate []byte) error
+	// UpdateSolutionUserGroups adds and removes the solution user from groups
+	UpdateSolutionUserGroups(ctx context.Context, name string, added, removed []string) error
+	// DeleteSolutionUser unregisters a solution user
+	DeleteSolutionUser(ctx context.Context, name string) error
+	// CreateUser creates a SSO person user with the password and description and adds it to the groups
+	CreateUser(ctx context.Context, name, password, description string, groups []string) error
+	// ListUsers lists the SSO person users of the SSO domain
+	ListUsers(ctx context.Context) ([]ssoUser, error)
+	// DeleteUser deletes a SSO person user along with its group memberships. A missing user is not an error.
+	DeleteUser(ctx context.Context, name string) error
+	// GrantPermissions grants the vSphere roles to a SSO user on the entities
+	GrantPermissions(ctx context.Context, name string, permissions []vspherePermission) error
+	// RevokePermissions removes the permissions of a SSO user on the entities. The missing permissions are ignored.
+	RevokePermissions(ctx context.Context, name string, permissions []vspherePermission) error
+	// ListPrivileges lists the privileges defined by vCenter
+	ListPrivileges(ctx context.Context) ([]types.AuthorizationPrivilege, error)
+	// ListRoles lists the vSphere roles with their privileges
+	ListRoles(ctx context.Context) ([]types.AuthorizationRole, error)
+	// CreateOrUpdateRole creates a vSphere role with the privileges, or replaces the privileges of an existing one
+	CreateOrUpdateRole(ctx context.Context, name string, privileges []string) error
+	// DeleteRoleIfUnused deletes a vSphere role unless a permission grants it. It returns whether the role no longer exists.
+	DeleteRoleIfUnused(ctx context.Context, name string) (bool, error)
+	// ListTaggedObjects lists the objects a tag is attached to. The tag and its category are given by name.
+	ListTaggedObjects(ctx context.Context, category, tag string) ([]types.ManagedObjectReference, error)
+	// ListUserPermissions lists the permissions granted to the users of the SSO domain, by user name
+	ListUserPermissions(ctx context.Context) (map[string][]vspherePermission, error)
+	// ListVCenterEndpoints lists the vCenters registered with the lookup service of the SSO domain
+	ListVCenterEndpoints(ctx context.Context) ([]vcenterEndpoint, error)
+	// SSOEndpoints returns the URLs of the SSO services used to issue tokens and manage principals
+	SSOEndpoints(ctx context.Context) (*ssoEndpoints, error)
+	// SessionIsActive returns whether the session of the mount is still authenticated
+	SessionIsActive(ctx context.Context) (bool, error)
+	// Close logs out the session of the mount
+	Close(ctx context.Context) error
+}
+
+// vcenterEndpoint is a vCenter registered in the SSO domain. With Enhanced Linked Mode,
+// a SSO domain backs several vCenters.
+type vcenterEndpoint struct {
+	URL          string `json:"url"`
+	InstanceName string `json:"instance_name"`
+	InstanceUUID string `json:"instance_uuid"`
+	SiteID       string `json:"site_id"`
+	NodeID       string `json:"node_id"`
+}
+
+// maxListedUsers bounds the number of SSO users listed at once.
+const maxListedUsers = 10000
+
+// vspherePermission grants a vSphere role on an inventory entity, referenced as "Type:value".
+// The permissions propagate to the children of the entity.
+type vspherePermission struct {
+	Entity string `json:"entity"`
+	Role   string `json:"role"`
+}
+
+// ssoUser is a SSO person user. The description of the users created by the plugin identifies the mount.
+type ssoUser struct {
+	Name        string
+	Description string
 }
 
 // provider is a concrete implementation of vSphereProvider. In most cases it is a simple passthrough
@@ -35,6 +114,13 @@ type VSphereProvider interface {
 type provider struct {
 	settings      *clientSettings
 	govmomiClient *govmomi.Client
+	// relogin is nil when the mount has no credentials and the client is not logged in.
+	relogin *reloginRoundTripper
+
+	ssoLock      sync.Mutex
+	ssoEndpoints *ssoEndpoints
+
+	logger hclog.Logger
 }
 
 // GetMountGovmomiClient returns the underlying govmami.Client using the credentials defined in the config of the mount.
@@ -48,12 +134,59 @@ func (p *provider) Login(ctx context.Context, username, password string, toBeDef
 	return p.settings.makeGovmomiClient(ctx, username, password)
 }
 
-func (p *provider) IssueUserToken(ctx context.Context, username, password string, ttl time.Duration, renewable, delegatable bool) (*sts.Signer, error) {
-	c, err := p.Login(ctx, username, password, nil)
+// SessionIsActive checks the session of the mount. A client that is not logged in has no session to check.
+func (p *provider) SessionIsActive(ctx context.Context) (bool, error) {
+	if p.relogin == nil {
+		return true, nil
+	}
+	s, err := p.govmomiClient.SessionManager.UserSession(ctx)
+	if err != nil {
+		return false, err
+	}
+	return s != nil, nil
+}
+
+// Close logs out the session of the mount and stops logging in again.
+func (p *provider) Close(ctx context.Context) error {
+	if p.relogin == nil {
+		return nil
+	}
+	p.relogin.close()
+	return p.govmomiClient.Logout(ctx)
+}
+
+// SSOEndpoints resolves the SSO endpoints once with the mount client.
+func (p *provider) SSOEndpoints(ctx context.Context) (*ssoEndpoints, error) {
+	p.ssoLock.Lock()
+	defer p.ssoLock.Unlock()
+
+	if p.ssoEndpoints != nil {
+		return p.ssoEndpoints, nil
+	}
+
+	endpoints, err := p.settings.resolveSSOEndpoints(ctx, p.govmomiClient.Client)
+	if err != nil {
+		return nil, err
+	}
+	p.ssoEndpoints = endpoints
+	return endpoints, nil
+}
+
+// stsClient returns a client of the STS presenting the solution certificate when defined.
+func (p *provider) stsClient(ctx context.Context) (*sts.Client, error) {
+	endpoints, err := p.SSOEndpoints(ctx)
 	if err != nil {
 		return nil, err
 	}
-	stsClient, err := sts.NewClient(ctx, c.Client)
+	c, err := p.settings.makeVimClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.settings.newSTSClient(c, endpoints), nil
+}
+
+func (p *provider) IssueUserToken(ctx context.Context, username, password string, ttl time.Duration, renewable, delegatable bool) (*sts.Signer, error) {
+	stsClient, err := p.stsClient(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -73,11 +206,7 @@ func (p *provider) IssueUserToken(ctx context.Context, username, password string
 }
 
 func (p *provider) IssueSolutionToken(ctx context.Context, solutionCert *tls.Certificate, token string, ttl time.Duration, renewable, delegatable bool) (*sts.Signer, error) {
-	c, err := p.Login(ctx, "", "", nil) //solutionCert, nil) // TODO: make a vim25 client directly probably
-	if err != nil {
-		return nil, err
-	}
-	stsClient, err := sts.NewClient(ctx, c.Client)
+	stsClient, err := p.stsClient(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -110,12 +239,431 @@ func (p *provider) RevokeSession(ctx context.Context, toBeDefined map[string]int
 	return nil
 }
 
+// withSSOAdminClient logs in the SSO admin service with the credentials of the mount and calls f.
+func (p *provider) withSSOAdminClient(ctx context.Context, f func(*ssoadmin.Client) error) error {
+	endpoints, err := p.SSOEndpoints(ctx)
+	if err != nil {
+		return err
+	}
+
+	vimClient := p.govmomiClient.Client
+	c, err := p.settings.newSSOAdminClient(ctx, vimClient, endpoints)
+	if err != nil {
+		return err
+	}
+
+	stsClient := p.settings.newSTSClient(vimClient, endpoints)
+	req := sts.TokenRequest{
+		Certificate: p.settings.SolutionCertificate,
+	}
+	if p.settings.SolutionCertificate == nil {
+		req.Userinfo = p.settings.Userinfo()
+	}
+	signer, err := stsClient.Issue(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	header := soap.Header{Security: signer}
+	if err = c.Login(c.WithHeader(ctx, header)); err != nil {
+		return err
+	}
+	defer func() {
+		if err := c.Logout(ctx); err != nil {
+			p.logger.Warn("error logging out of the SSO admin service", "error", err)
+		}
+	}()
+
+	return f(c)
+}
+
+func (p *provider) CreateSolutionUser(ctx context.Context, name string, certificate []byte, groups []string) error {
+	return p.withSSOAdminClient(ctx, func(c *ssoadmin.Client) error {
+		return registerSolutionUser(ctx, c, c.Domain, name, certificate, groups, p.logger)
+	})
+}
+
+// solutionUserAdmin is the part of the SSO admin client that registers the solution users.
+type solutionUserAdmin interface {
+	CreateSolutionUser(ctx context.Context, name string, details ssotypes.AdminSolutionDetails) error
+	AddUsersToGroup(ctx context.Context, groupName string, userIDs ...ssotypes.PrincipalId) error
+	DeletePrincipal(ctx context.Context, name string) error
+}
+
+// registerSolutionUser creates a solution user and adds it to the groups. The solution user is deleted
+// when it can not be added to a group, so that the registration can be retried.
+func registerSolutionUser(ctx context.Context, c solutionUserAdmin, domain, name string, certificate []byte, groups []string, logger hclog.Logger) error {
+	details := ssotypes.AdminSolutionDetails{
+		Certificate: base64.StdEncoding.EncodeToString(certificate),
+		Description: "Managed by the Vault vSphere secrets engine",
+	}
+	if err := c.CreateSolutionUser(ctx, name, details); err != nil {
+		return err
+	}
+	id := ssotypes.PrincipalId{Name: name, Domain: domain}
+	for _, group := range groups {
+		if err := c.AddUsersToGroup(ctx, group, id); err != nil {
+			if derr := c.DeletePrincipal(ctx, name); derr != nil {
+				logger.Warn("error deleting the solution user after a failed registration", "name", name, "error", derr)
+			}
+			return errwrap.Wrapf(fmt.Sprintf("error adding the solution user to the group '%s': {{err}}", group), err)
+		}
+	}
+	return nil
+}
+
+func (p *provider) UpdateSolutionUser(ctx context.Context, name string, certificate []byte) error {
+	return p.withSSOAdminClient(ctx, func(c *ssoadmin.Client) error {
+		details := ssotypes.AdminSolutionDetails{
+			Certificate: base64.StdEncoding.EncodeToString(certificate),
+			Description: "Managed by the Vault vSphere secrets engine",
+		}
+		return c.UpdateSolutionUser(ctx, name, details)
+	})
+}
+
+func (p *provider) UpdateSolutionUserGroups(ctx context.Context, name string, added, removed []string) error {
+	return p.withSSOAdminClient(ctx, func(c *ssoadmin.Client) error {
+		id := ssotypes.PrincipalId{Name: name, Domain: c.Domain}
+		for _, group := range added {
+			if err := c.AddUsersToGroup(ctx, group, id); err != nil {
+				return err
+			}
+		}
+		for _, group := range removed {
+			if err := c.RemoveUsersFromGroup(ctx, group, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *provider) DeleteSolutionUser(ctx context.Context, name string) error {
+	return p.withSSOAdminClient(ctx, func(c *ssoadmin.Client) error {
+		return c.DeletePrincipal(ctx, name)
+	})
+}
+
+func (p *provider) CreateUser(ctx context.Context, name, password, description string, groups []string) error {
+	return p.withSSOAdminClient(ctx, func(c *ssoadmin.Client) error {
+		details := ssotypes.AdminPersonDetails{
+			Description: description,
+		}
+		if err := c.CreatePersonUser(ctx, name, details, password); err != nil {
+			return err
+		}
+		id := ssotypes.PrincipalId{Name: name, Domain: c.Domain}
+		for _, group := range groups {
+			if err := c.AddUsersToGroup(ctx, group, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *provider) DeleteUser(ctx context.Context, name string) error {
+	return p.withSSOAdminClient(ctx, func(c *ssoadmin.Client) error {
+		user, err := c.FindPersonUser(ctx, name)
+		if err != nil {
+			return err
+		}
+		if user == nil {
+			return nil
+		}
+		return c.DeletePrincipal(ctx, name)
+	})
+}
+
+func (p *provider) ListUsers(ctx context.Context) ([]ssoUser, error) {
+	var users []ssoUser
+	err := p.withSSOAdminClient(ctx, func(c *ssoadmin.Client) error {
+		c.Limit = maxListedUsers
+		found, err := c.FindPersonUsers(ctx, "")
+		if err != nil {
+			return err
+		}
+		for _, u := range found {
+			users = append(users, ssoUser{Name: u.Id.Name, Description: u.Details.Description})
+		}
+		return nil
+	})
+	return users, err
+}
+
+// userPrincipal returns the name of a SSO user in the vCenter permissions: DOMAIN\name.
+func (p *provider) userPrincipal(ctx context.Context, name string) (string, error) {
+	endpoints, err := p.SSOEndpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(endpoints.SSOAdminURL)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(ssoDomain(u)) + `\` + name, nil
+}
+
+func (p *provider) GrantPermissions(ctx context.Context, name string, permissions []vspherePermission) error {
+	principal, err := p.userPrincipal(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	m := object.NewAuthorizationManager(p.govmomiClient.Client)
+	roles, err := m.RoleList(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, permission := range permissions {
+		role := roles.ByName(permission.Role)
+		if role == nil {
+			return fmt.Errorf("vSphere role '%s' does not exist", permission.Role)
+		}
+		var entity types.ManagedObjectReference
+		if !entity.FromString(permission.Entity) {
+			return fmt.Errorf("invalid entity reference '%s'", permission.Entity)
+		}
+		err := m.SetEntityPermissions(ctx, entity, []types.Permission{{
+			Entity:    &entity,
+			Principal: principal,
+			RoleId:    role.RoleId,
+			Propagate: true,
+		}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *provider) RevokePermissions(ctx context.Context, name string, permissions []vspherePermission) error {
+	principal, err := p.userPrincipal(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	m := object.NewAuthorizationManager(p.govmomiClient.Client)
+	for _, permission := range permissions {
+		var entity types.ManagedObjectReference
+		if !entity.FromString(permission.Entity) {
+			return fmt.Errorf("invalid entity reference '%s'", permission.Entity)
+		}
+		err := m.RemoveEntityPermission(ctx, entity, principal, false)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *provider) ListUserPermissions(ctx context.Context) (map[string][]vspherePermission, error) {
+	endpoints, err := p.SSOEndpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(endpoints.SSOAdminURL)
+	if err != nil {
+		return nil, err
+	}
+	domainPrefix := strings.ToUpper(ssoDomain(u)) + `\`
+
+	m := object.NewAuthorizationManager(p.govmomiClient.Client)
+	roles, err := m.RoleList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	all, err := m.RetrieveAllPermissions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	permissions := make(map[string][]vspherePermission)
+	for _, permission := range all {
+		if permission.Entity == nil || permission.Group || !strings.HasPrefix(strings.ToUpper(permission.Principal), domainPrefix) {
+			continue
+		}
+		var role string
+		if r := roles.ById(permission.RoleId); r != nil {
+			role = r.Name
+		}
+		name := permission.Principal[len(domainPrefix):]
+		permissions[name] = append(permissions[name], vspherePermission{
+			Entity: permission.Entity.String(),
+			Role:   role,
+		})
+	}
+	return permissions, nil
+}
+
+func (p *provider) ListPrivileges(ctx context.Context) ([]types.AuthorizationPrivilege, error) {
+	var m mo.AuthorizationManager
+	err := p.govmomiClient.RetrieveOne(ctx, *p.govmomiClient.ServiceContent.AuthorizationManager, []string{"privilegeList"}, &m)
+	if err != nil {
+		return nil, err
+	}
+	return m.PrivilegeList, nil
+}
+
+func (p *provider) ListRoles(ctx context.Context) ([]types.AuthorizationRole, error) {
+	return object.NewAuthorizationManager(p.govmomiClient.Client).RoleList(ctx)
+}
+
+func (p *provider) CreateOrUpdateRole(ctx context.Context, name string, privileges []string) error {
+	m := object.NewAuthorizationManager(p.govmomiClient.Client)
+	roles, err := m.RoleList(ctx)
+	if err != nil {
+		return err
+	}
+	if role := roles.ByName(name); role != nil {
+		return m.UpdateRole(ctx, role.RoleId, name, privileges)
+	}
+	_, err = m.AddRole(ctx, name, privileges)
+	return err
+}
+
+func (p *provider) DeleteRoleIfUnused(ctx context.Context, name string) (bool, error) {
+	m := object.NewAuthorizationManager(p.govmomiClient.Client)
+	roles, err := m.RoleList(ctx)
+	if err != nil {
+		return false, err
+	}
+	role := roles.ByName(name)
+	if role == nil {
+		return true, nil
+	}
+	permissions, err := m.RetrieveRolePermissions(ctx, role.RoleId)
+	if err != nil {
+		return false, err
+	}
+	if len(permissions) != 0 {
+		return false, nil
+	}
+	err = m.RemoveRole(ctx, role.RoleId, true)
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+	return true, nil
+}
+
+// withRestClient logs in the vAPI REST endpoint with the credentials of the mount and calls f.
+func (p *provider) withRestClient(ctx context.Context, f func(*rest.Client) error) error {
+	c := p.settings.newRestClient(p.govmomiClient.Client)
+	if p.settings.SolutionCertificate != nil {
+		endpoints, err := p.SSOEndpoints(ctx)
+		if err != nil {
+			return err
+		}
+		signer, err := p.settings.newSTSClient(p.govmomiClient.Client, endpoints).Issue(ctx, sts.TokenRequest{
+			Certificate: p.settings.SolutionCertificate,
+		})
+		if err != nil {
+			return err
+		}
+		if err := c.LoginByToken(c.WithSigner(ctx, signer)); err != nil {
+			return err
+		}
+	} else if err := c.Login(ctx, p.settings.Userinfo()); err != nil {
+		return err
+	}
+	defer func() {
+		if err := c.Logout(ctx); err != nil {
+			p.logger.Warn("error logging out of the vAPI REST endpoint", "error", err)
+		}
+	}()
+
+	return f(c)
+}
+
+func (p *provider) ListTaggedObjects(ctx context.Context, category, tag string) ([]types.ManagedObjectReference, error) {
+	var refs []types.ManagedObjectReference
+	err := p.withRestClient(ctx, func(c *rest.Client) error {
+		m := tags.NewManager(c)
+		t, err := m.GetTagForCategory(ctx, tag, category)
+		if err != nil {
+			return err
+		}
+		objects, err := m.ListAttachedObjects(ctx, t.ID)
+		if err != nil {
+			return err
+		}
+		for _, o := range objects {
+			refs = append(refs, o.Reference())
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// isNotFound returns whether the error is a NotFound fault, such as a missing permission.
+func isNotFound(err error) bool {
+	if !soap.IsSoapFault(err) {
+		return false
+	}
+	_, ok := soap.ToSoapFault(err).VimFault().(types.NotFound)
+	return ok
+}
+
+func (p *provider) ListVCenterEndpoints(ctx context.Context) ([]vcenterEndpoint, error) {
+	c, err := p.settings.newLookupClient(ctx, p.govmomiClient.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := &ltypes.LookupServiceRegistrationFilter{
+		ServiceType: &ltypes.LookupServiceRegistrationServiceType{
+			Product: "com.vmware.cis",
+			Type:    "vcenterserver",
+		},
+		EndpointType: &ltypes.LookupServiceRegistrationEndpointType{
+			Protocol: "vmomi",
+			Type:     "com.vmware.vim",
+		},
+	}
+	infos, err := c.List(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []vcenterEndpoint
+	for _, info := range infos {
+		var instanceName string
+		for _, attr := range info.ServiceAttributes {
+			if attr.Key == "com.vmware.vim.vcenter.instanceName" {
+				instanceName = attr.Value
+			}
+		}
+		for _, e := range info.ServiceEndpoints {
+			endpoints = append(endpoints, vcenterEndpoint{
+				URL:          e.Url,
+				InstanceName: instanceName,
+				InstanceUUID: info.ServiceId,
+				SiteID:       info.SiteId,
+				NodeID:       info.NodeId,
+			})
+		}
+	}
+	return endpoints, nil
+}
+
 func (p *provider) UserExists(ctx context.Context, username string) (bool, error) {
-	return false, nil
+	var exists bool
+	err := p.withSSOAdminClient(ctx, func(c *ssoadmin.Client) error {
+		user, err := c.FindUser(ctx, username)
+		exists = user != nil
+		return err
+	})
+	return exists, err
 }
 
 func (p *provider) RoleExists(ctx context.Context, role string) (bool, error) {
-	return false, nil
+	roles, err := object.NewAuthorizationManager(p.govmomiClient.Client).RoleList(ctx)
+	if err != nil {
+		return false, err
+	}
+	return roles.ByName(role) != nil, nil
 }
 
 func (p *provider) GroupExists(ctx context.Context, group string) (bool, error) {
@@ -123,15 +671,17 @@ func (p *provider) GroupExists(ctx context.Context, group string) (bool, error)
 }
 
 // newVSphereProvider creates an vsphereProvider, backed by VSphere client objects for underlying services.
-func newVSphereProvider(ctx context.Context, settings *clientSettings) (VSphereProvider, error) {
-	govmomiClient, err := settings.makeGovmomiClient(ctx, settings.Username, settings.Password)
+func newVSphereProvider(ctx context.Context, settings *clientSettings, logger hclog.Logger) (VSphereProvider, error) {
+	govmomiClient, relogin, err := settings.makeMountGovmomiClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	p := &provider{
 		govmomiClient: govmomiClient,
+		relogin:       relogin,
 		settings:      settings,
+		logger:        logger,
 	}
 	return p, nil
 }
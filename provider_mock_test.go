@@ -0,0 +1,183 @@
+package vspheresecrets
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// mockProvider wraps a provider connected to the simulator and keeps the
+// state of the services that are not simulated, such as the SSO admin service, in memory.
+type mockProvider struct {
+	VSphereProvider
+
+	lock          sync.Mutex
+	solutionUsers map[string][]byte
+	// users maps the SSO person users to their description.
+	users        map[string]string
+	groupMembers map[string][]string
+
+	// deleteUserErr fails the deletion of the users when set.
+	deleteUserErr error
+}
+
+func newMockProvider() *mockProvider {
+	return &mockProvider{
+		solutionUsers: make(map[string][]byte),
+		users:         make(map[string]string),
+		groupMembers:  make(map[string][]string),
+	}
+}
+
+// useMockProvider makes the backend create providers that share the state of the returned mockProvider.
+func useMockProvider(b *vsphereSecretBackend) *mockProvider {
+	m := newMockProvider()
+	b.getProvider = func(ctx context.Context, settings *clientSettings, logger hclog.Logger) (VSphereProvider, error) {
+		p, err := newVSphereProvider(ctx, settings, logger)
+		if err != nil {
+			return nil, err
+		}
+		m.lock.Lock()
+		m.VSphereProvider = p
+		m.lock.Unlock()
+		return m, nil
+	}
+	return m
+}
+
+func (m *mockProvider) CreateSolutionUser(ctx context.Context, name string, certificate []byte, groups []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.solutionUsers[name] = certificate
+	for _, group := range groups {
+		m.groupMembers[group] = strutil.AppendIfMissing(m.groupMembers[group], name)
+	}
+	return nil
+}
+
+func (m *mockProvider) UpdateSolutionUser(ctx context.Context, name string, certificate []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.solutionUsers[name] = certificate
+	return nil
+}
+
+func (m *mockProvider) UpdateSolutionUserGroups(ctx context.Context, name string, added, removed []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, group := range added {
+		m.groupMembers[group] = strutil.AppendIfMissing(m.groupMembers[group], name)
+	}
+	for _, group := range removed {
+		m.groupMembers[group] = strutil.StrListDelete(m.groupMembers[group], name)
+	}
+	return nil
+}
+
+func (m *mockProvider) DeleteSolutionUser(ctx context.Context, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.solutionUsers, name)
+	for group, members := range m.groupMembers {
+		m.groupMembers[group] = strutil.StrListDelete(members, name)
+	}
+	return nil
+}
+
+func (m *mockProvider) CreateUser(ctx context.Context, name, password, description string, groups []string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.users[name]; ok {
+		return fmt.Errorf("user '%s' already exists", name)
+	}
+	m.users[name] = description
+	for _, group := range groups {
+		m.groupMembers[group] = strutil.AppendIfMissing(m.groupMembers[group], name)
+	}
+	return nil
+}
+
+func (m *mockProvider) DeleteUser(ctx context.Context, name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.deleteUserErr != nil {
+		return m.deleteUserErr
+	}
+	delete(m.users, name)
+	for group, members := range m.groupMembers {
+		m.groupMembers[group] = strutil.StrListDelete(members, name)
+	}
+	return nil
+}
+
+func (m *mockProvider) ListUsers(ctx context.Context) ([]ssoUser, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var users []ssoUser
+	for name, description := range m.users {
+		users = append(users, ssoUser{Name: name, Description: description})
+	}
+	return users, nil
+}
+
+func (m *mockProvider) UserExists(ctx context.Context, name string) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.users[name]
+	return ok, nil
+}
+
+func (m *mockProvider) setDeleteUserErr(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.deleteUserErr = err
+}
+
+func (m *mockProvider) userExists(name string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, ok := m.users[name]
+	return ok
+}
+
+func (m *mockProvider) userCount() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.users)
+}
+
+func (m *mockProvider) solutionUserCertificate(name string) []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.solutionUsers[name]
+}
+
+func (m *mockProvider) isGroupMember(group, name string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return strutil.StrListContains(m.groupMembers[group], name)
+}
+
+// ListPrivileges returns the privileges of the Admin role: the simulator does not define the privilege list.
+func (m *mockProvider) ListPrivileges(ctx context.Context) ([]types.AuthorizationPrivilege, error) {
+	roles, err := object.NewAuthorizationManager(m.GetMountGovmomiClient().Client).RoleList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var privileges []types.AuthorizationPrivilege
+	for _, id := range roles.ByName("Admin").Privilege {
+		i := strings.LastIndex(id, ".")
+		privileges = append(privileges, types.AuthorizationPrivilege{
+			PrivId:        id,
+			Name:          id[i+1:],
+			PrivGroupName: id[:i],
+		})
+	}
+	return privileges, nil
+}
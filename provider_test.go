@@ -2,10 +2,15 @@ package vspheresecrets
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/go-hclog"
 	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+	ssotypes "github.com/vmware/govmomi/ssoadmin/types"
 )
 
 func TestProvider(t *testing.T) {
@@ -19,7 +24,7 @@ func TestProvider(t *testing.T) {
 	if storage == nil {
 		t.Fatal("The storage must not be nil")
 	}
-	provider, err := b.getProvider(context.Background(), b.settings)
+	provider, err := b.getProvider(context.Background(), b.connection(defaultConnectionName).settings, b.Logger())
 	nilErr(t, err)
 	t.Run("Test provider.Login", func(t *testing.T) {
 		ctx := context.Background()
@@ -37,6 +42,54 @@ func TestProvider(t *testing.T) {
 	})
 
 	t.Run("Test provider.IssueSolutionToken", func(t *testing.T) {
-		t.Skip("Not supported yet")
+		ctx := context.Background()
+		certificate, privateKey := generateTestCertificate(t, "vault-solution")
+		solutionCert, err := tls.X509KeyPair([]byte(certificate), []byte(privateKey))
+		nilErr(t, err)
+		signer, err := provider.IssueSolutionToken(ctx, &solutionCert, "", 30*time.Second, true, true)
+		nilErr(t, err)
+		c, err := makeGovmomiClientFromToken(ctx, b, signer)
+		nilErr(t, err)
+		testListDatacenters(t, c)
 	})
 }
+
+// fakeSolutionUserAdmin records the solution users of a SSO domain whose groups can not be joined.
+type fakeSolutionUserAdmin struct {
+	solutionUsers map[string]bool
+	addErr        error
+}
+
+func (f *fakeSolutionUserAdmin) CreateSolutionUser(ctx context.Context, name string, details ssotypes.AdminSolutionDetails) error {
+	if f.solutionUsers[name] {
+		return fmt.Errorf("solution user '%s' already exists", name)
+	}
+	f.solutionUsers[name] = true
+	return nil
+}
+
+func (f *fakeSolutionUserAdmin) AddUsersToGroup(ctx context.Context, groupName string, userIDs ...ssotypes.PrincipalId) error {
+	return f.addErr
+}
+
+func (f *fakeSolutionUserAdmin) DeletePrincipal(ctx context.Context, name string) error {
+	delete(f.solutionUsers, name)
+	return nil
+}
+
+func TestRegisterSolutionUserRollback(t *testing.T) {
+	ctx := context.Background()
+	logger := hclog.NewNullLogger()
+	admin := &fakeSolutionUserAdmin{solutionUsers: make(map[string]bool), addErr: errors.New("group not found")}
+
+	// the solution user is deleted when it can not be added to a group
+	if err := registerSolutionUser(ctx, admin, "vsphere.local", "vault", []byte("cert"), []string{"Missing"}, logger); err == nil {
+		t.Fatal("expected the registration to fail")
+	}
+	equal(t, 0, len(admin.solutionUsers))
+
+	// so that the registration can be retried
+	admin.addErr = nil
+	nilErr(t, registerSolutionUser(ctx, admin, "vsphere.local", "vault", []byte("cert"), []string{"ActAsUsers"}, logger))
+	equal(t, true, admin.solutionUsers["vault"])
+}
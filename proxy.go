@@ -0,0 +1,168 @@
+package vspheresecrets
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// proxyFunc returns the proxy function of the transports of the clients.
+// Without a configured proxy, the proxy environment variables apply.
+func (settings *clientSettings) proxyFunc() func(*http.Request) (*url.URL, error) {
+	if settings.ProxyURL == nil {
+		return http.ProxyFromEnvironment
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if matchNoProxy(settings.NoProxy, req.URL.Host) {
+			return nil, nil
+		}
+		return settings.ProxyURL, nil
+	}
+}
+
+// applyProxy configures the transport of a soap client with the proxy settings.
+func (settings *clientSettings) applyProxy(transport http.RoundTripper) {
+	if t, ok := transport.(*http.Transport); ok {
+		t.Proxy = settings.proxyFunc()
+	}
+}
+
+// matchNoProxy returns whether the host matches one of the no_proxy patterns:
+// "*", an IP address or CIDR, a host name matching its sub domains, ".domain" or host:port.
+// Unlike the proxy environment variables, the loopback addresses are proxied unless excluded.
+func matchNoProxy(patterns []string, hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, p := range patterns {
+		p = strings.ToLower(strings.TrimSpace(p))
+		switch {
+		case p == "":
+		case p == "*":
+			return true
+		case p == hostport || p == host:
+			return true
+		case strings.HasPrefix(p, "."):
+			if strings.HasSuffix(host, p) {
+				return true
+			}
+		case strings.Contains(p, "/"):
+			if _, cidr, err := net.ParseCIDR(p); err == nil && ip != nil && cidr.Contains(ip) {
+				return true
+			}
+		case strings.HasSuffix(host, "."+p):
+			return true
+		}
+	}
+	return false
+}
+
+// redactProxyURL returns the proxy URL without its password.
+func redactProxyURL(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	redacted := *u
+	if u.User != nil {
+		redacted.User = url.User(u.User.Username())
+	}
+	return redacted.String()
+}
+
+// redactRawProxyURL returns the proxy URL of a config without its password.
+func redactRawProxyURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return redactProxyURL(u)
+}
+
+// dialTLS opens a TLS connection to the address, through the proxy when one applies.
+func dialTLS(ctx context.Context, dialer *net.Dialer, proxy func(*http.Request) (*url.URL, error), u *url.URL, addr string, config *tls.Config) (*tls.Conn, error) {
+	proxyURL, err := proxy(&http.Request{URL: u})
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return tls.DialWithDialer(dialer, "tcp", addr, config)
+	}
+
+	conn, err := dialProxyTunnel(dialer, proxyURL, addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.ServerName == "" {
+		config.ServerName = u.Hostname()
+	}
+	tlsConn := tls.Client(conn, config)
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = tlsConn.SetDeadline(deadline)
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialProxyTunnel opens a tunnel to the address with the CONNECT method of the proxy.
+func dialProxyTunnel(dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		if proxyURL.Scheme == "https" {
+			proxyAddr += ":443"
+		} else {
+			proxyAddr += ":80"
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if proxyURL.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", proxyAddr, &tls.Config{ServerName: proxyURL.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", proxyAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused the connection to %s: %s", addr, res.Status)
+	}
+	return conn, nil
+}
@@ -0,0 +1,258 @@
+package vspheresecrets
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+)
+
+// testProxy is a forward proxy that records the requests it serves.
+// It forwards the absolute URL requests and tunnels the CONNECT requests.
+type testProxy struct {
+	*httptest.Server
+	auth string
+
+	lock     sync.Mutex
+	requests []string
+}
+
+func newTestProxy(t *testing.T, username, password string) *testProxy {
+	t.Helper()
+	p := &testProxy{
+		auth: "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)),
+	}
+	p.Server = httptest.NewServer(p)
+	return p
+}
+
+// proxyURL returns the URL of the proxy with the credentials.
+func (p *testProxy) proxyURL(username, password string) string {
+	u, _ := url.Parse(p.URL)
+	u.User = url.UserPassword(username, password)
+	return u.String()
+}
+
+// served returns the requests served, as the method and the URL or the tunneled host.
+func (p *testProxy) served() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]string(nil), p.requests...)
+}
+
+func (p *testProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Proxy-Authorization") != p.auth {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+	p.lock.Lock()
+	p.requests = append(p.requests, r.Method+" "+r.RequestURI)
+	p.lock.Unlock()
+
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+
+	out := r.WithContext(r.Context())
+	out.RequestURI = ""
+	out.Header = r.Header.Clone()
+	out.Header.Del("Proxy-Authorization")
+	res, err := new(http.Transport).RoundTrip(out)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+	for k, v := range res.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(res.StatusCode)
+	_, _ = io.Copy(w, res.Body)
+}
+
+func (p *testProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+		upstream.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(conn, upstream)
+		conn.Close()
+	}()
+}
+
+// proxiedPaths fails the test unless a request was served for each path.
+func (p *testProxy) proxiedPaths(t *testing.T, paths ...string) {
+	t.Helper()
+	served := p.served()
+	for _, path := range paths {
+		found := false
+		for _, r := range served {
+			if strings.Contains(r, path) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("expected a request to %s through the proxy, got %v", path, served)
+		}
+	}
+}
+
+func TestConfigProxy(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	proxy := newTestProxy(t, "proxyuser", "proxypass")
+	defer proxy.Close()
+
+	b, s := getTestBackend(t, false)
+	ctx := context.Background()
+
+	config := govmomitest.GetSimulatorConfig(true)
+	config["proxy_url"] = proxy.proxyURL("proxyuser", "proxypass")
+	testConfigCreate(t, b, s, config)
+	proxy.proxiedPaths(t, "/sdk")
+
+	t.Run("Read", func(t *testing.T) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "config",
+			Storage:   s,
+		})
+		nilErr(t, err)
+		equal(t, strings.Replace(proxy.URL, "http://", "http://proxyuser@", 1), resp.Data["proxy_url"])
+	})
+
+	t.Run("Services", func(t *testing.T) {
+		b.reset()
+		client, err := b.getClient(ctx, s)
+		nilErr(t, err)
+		testListDatacenters(t, client.provider.GetMountGovmomiClient())
+
+		_, err = client.provider.SSOEndpoints(ctx)
+		nilErr(t, err)
+		_, err = client.provider.IssueUserToken(ctx, govmomitest.SimulatorServerSudoerUsername, govmomitest.SimulatorServerSudoerPassword, 0, false, false)
+		nilErr(t, err)
+
+		rc := client.settings.newRestClient(client.provider.GetMountGovmomiClient().Client)
+		nilErr(t, rc.Login(ctx, url.UserPassword(govmomitest.SimulatorServerSudoerUsername, govmomitest.SimulatorServerSudoerPassword)))
+
+		proxy.proxiedPaths(t, "/lookupservice/sdk", "/sts/STSService", "/rest/")
+	})
+
+	t.Run("NoProxy", func(t *testing.T) {
+		testConfigUpdate(t, b, s, map[string]interface{}{"no_proxy": "example.com,127.0.0.0/8"})
+		b.reset()
+		before := len(proxy.served())
+		client, err := b.getClient(ctx, s)
+		nilErr(t, err)
+		testListDatacenters(t, client.provider.GetMountGovmomiClient())
+		equal(t, before, len(proxy.served()))
+	})
+
+	t.Run("ProxyAuthentication", func(t *testing.T) {
+		resp, _ := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config",
+			Data: map[string]interface{}{
+				"proxy_url": proxy.proxyURL("proxyuser", "wrong"),
+				"no_proxy":  "",
+			},
+			Storage: s,
+		})
+		if !resp.IsError() {
+			t.Fatal("expected the config write to fail through the proxy")
+		}
+	})
+
+	t.Run("InvalidProxyURL", func(t *testing.T) {
+		resp, _ := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "config",
+			Data:      map[string]interface{}{"proxy_url": "socks5://127.0.0.1:1080"},
+			Storage:   s,
+		})
+		if !resp.IsError() {
+			t.Fatal("expected a response error")
+		}
+	})
+}
+
+func TestConfigProxyTLS(t *testing.T) {
+	_ = govmomitest.SetupTLS(t)
+	defer govmomitest.TearDown()
+
+	proxy := newTestProxy(t, "proxyuser", "proxypass")
+	defer proxy.Close()
+
+	b, s := getTestBackend(t, false)
+	ctx := context.Background()
+
+	// the thumbprint is recorded and verified through the CONNECT tunnel
+	config := govmomitest.GetSimulatorConfig(true)
+	config["insecure"] = false
+	config["tofu"] = true
+	config["proxy_url"] = proxy.proxyURL("proxyuser", "proxypass")
+	testConfigCreate(t, b, s, config)
+
+	u, err := url.Parse(govmomitest.SimulatorURL)
+	nilErr(t, err)
+	proxy.proxiedPaths(t, "CONNECT "+u.Host)
+
+	b.reset()
+	stored, err := b.getConfig(ctx, s)
+	nilErr(t, err)
+	if stored.Thumbprint == "" {
+		t.Fatal("expected the thumbprint to be recorded")
+	}
+	client, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	testListDatacenters(t, client.provider.GetMountGovmomiClient())
+}
+
+func TestMatchNoProxy(t *testing.T) {
+	patterns := []string{"example.com", ".internal", "vc.local:8443", "10.0.0.0/8"}
+	tests := map[string]bool{
+		"example.com":      true,
+		"vc.example.com":   true,
+		"badexample.com":   false,
+		"psc.internal:443": true,
+		"internal":         false,
+		"vc.local:8443":    true,
+		"vc.local:443":     false,
+		"10.1.2.3:443":     true,
+		"11.1.2.3":         false,
+		"127.0.0.1:443":    false,
+	}
+	for host, expected := range tests {
+		if matchNoProxy(patterns, host) != expected {
+			t.Errorf("unexpected match of %s: expected %v", host, expected)
+		}
+	}
+	if !matchNoProxy([]string{"*"}, "anything:443") {
+		t.Error("expected * to match every host")
+	}
+}
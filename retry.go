@@ -0,0 +1,244 @@
+package vspheresecrets
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+// idempotentMethodPrefixes are the prefixes of the vSphere methods that only read state
+// and can be retried safely.
+var idempotentMethodPrefixes = []string{
+	"Retrieve",
+	"ContinueRetrieve",
+	"Find",
+	"Fetch",
+	"Query",
+	"List",
+	"Has",
+	"CurrentTime",
+	"SessionIsActive",
+	// the methods of the SSO services
+	"Get",
+	"SsoAdminServiceInstance",
+	"RequestSecurityToken",
+}
+
+// soapMethodRegex matches the method of a SOAP request, the first element of its body.
+var soapMethodRegex = regexp.MustCompile(`<(?:[\w-]+:)?Body[^>]*>\s*<(?:[\w-]+:)?(\w+)`)
+
+// retryRoundTripper retries the idempotent calls that fail with a transient error,
+// waiting for an exponential backoff between the attempts.
+type retryRoundTripper struct {
+	roundTripper soap.RoundTripper
+	maxRetries   int
+	backoff      time.Duration
+}
+
+// withRetries wraps the round tripper with the retry settings. The calls are never retried
+// for longer than retryTimeout.
+func (settings *clientSettings) withRetries(roundTripper soap.RoundTripper) soap.RoundTripper {
+	if settings.MaxRetries <= 0 {
+		return roundTripper
+	}
+	return &retryRoundTripper{
+		roundTripper: roundTripper,
+		maxRetries:   settings.MaxRetries,
+		backoff:      settings.RetryBackoff,
+	}
+}
+
+func (rt *retryRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	deadline := time.Now().Add(retryTimeout)
+	delay := rt.backoff
+
+	for attempt := 0; ; attempt++ {
+		err := rt.roundTripper.RoundTrip(ctx, req, res)
+		if err == nil || attempt >= rt.maxRetries || !isIdempotentMethod(req) || !isTransientError(err) {
+			return err
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+
+		resetResponse(res)
+	}
+}
+
+// isIdempotentMethod returns whether the method of the request body only reads state.
+// The request bodies are named after their method, for example RetrievePropertiesBody.
+func isIdempotentMethod(req soap.HasFault) bool {
+	t := reflect.TypeOf(req)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return isIdempotentMethodName(strings.TrimSuffix(t.Name(), "Body"))
+}
+
+// isIdempotentMethodName returns whether a vSphere or SSO method only reads state.
+func isIdempotentMethodName(name string) bool {
+	for _, prefix := range idempotentMethodPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTransientError returns whether the error may not happen again: a refused or dropped
+// connection, a timeout, a 502 or 503 response or a session that is not authenticated.
+func isTransientError(err error) bool {
+	if isNotAuthenticated(err) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) && urlErr.Err != nil {
+		if t, ok := urlErr.Err.(interface{ Temporary() bool }); ok && t.Temporary() {
+			return true
+		}
+		// the status errors of the soap client are the status of the response
+		if status := urlErr.Err.Error(); strings.HasPrefix(status, "502 ") || strings.HasPrefix(status, "503 ") {
+			return true
+		}
+	}
+	return false
+}
+
+// retryTransport retries the HTTP requests of the clients that do not go through the round tripper of
+// the vim25 client: the clients of the SSO services and of the vAPI REST endpoint. The requests that
+// only read state are retried on the transient errors, the others only when they were not processed:
+// a refused connection or a 502 or 503 response.
+type retryTransport struct {
+	transport  http.RoundTripper
+	maxRetries int
+	backoff    time.Duration
+}
+
+// withHTTPRetries wraps the HTTP transport with the retry settings. The requests are never retried
+// for longer than retryTimeout.
+func (settings *clientSettings) withHTTPRetries(transport http.RoundTripper) http.RoundTripper {
+	if settings.MaxRetries <= 0 {
+		return transport
+	}
+	return &retryTransport{
+		transport:  transport,
+		maxRetries: settings.MaxRetries,
+		backoff:    settings.RetryBackoff,
+	}
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// the soap client streams the body of its requests: it is read once to be sent again
+	if req.Body != nil && req.GetBody == nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.WithContext(req.Context())
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.Body, _ = req.GetBody()
+	}
+
+	idempotent := isIdempotentRequest(req)
+	deadline := time.Now().Add(retryTimeout)
+	delay := rt.backoff
+
+	for attempt := 0; ; attempt++ {
+		res, err := rt.transport.RoundTrip(req)
+		if attempt >= rt.maxRetries || !isRetriableResponse(res, err, idempotent) {
+			return res, err
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return res, err
+		}
+		if res != nil {
+			_, _ = io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		delay *= 2
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.WithContext(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// isRetriableResponse returns whether a request can be sent again after its response or error.
+func isRetriableResponse(res *http.Response, err error, idempotent bool) bool {
+	if err != nil {
+		return isTransientError(err) && (idempotent || errors.Is(err, syscall.ECONNREFUSED))
+	}
+	return res.StatusCode == http.StatusBadGateway || res.StatusCode == http.StatusServiceUnavailable
+}
+
+// isIdempotentRequest returns whether an HTTP request only reads state: a GET request, a vAPI list or get
+// action, or a SOAP request of a method that only reads state.
+func isIdempotentRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	}
+	if action := req.URL.Query().Get("~action"); action != "" {
+		return strings.HasPrefix(action, "list") || strings.HasPrefix(action, "get")
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	defer body.Close()
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return false
+	}
+	m := soapMethodRegex.FindSubmatch(b)
+	return m != nil && isIdempotentMethodName(string(m[1]))
+}
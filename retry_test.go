@@ -0,0 +1,217 @@
+package vspheresecrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+	ssomethods "github.com/vmware/govmomi/ssoadmin/methods"
+	ssotypes "github.com/vmware/govmomi/ssoadmin/types"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// failingRoundTripper fails the first calls with an error.
+type failingRoundTripper struct {
+	err      error
+	failures int
+	calls    int
+}
+
+func (rt *failingRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	rt.calls++
+	if rt.calls <= rt.failures {
+		return rt.err
+	}
+	return nil
+}
+
+func TestRetryRoundTripper(t *testing.T) {
+	ctx := context.Background()
+	settings := &clientSettings{
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+	}
+	invalid := &url.Error{Op: "Post", URL: "/sdk", Err: errors.New("invalid argument")}
+
+	tests := map[string]struct {
+		err      error
+		failures int
+		req      soap.HasFault
+		calls    int
+		fails    bool
+	}{
+		"transient error retried": {
+			err:      &net.DNSError{IsTimeout: true},
+			failures: 2,
+			req:      new(methods.RetrievePropertiesBody),
+			calls:    3,
+		},
+		"retries exhausted": {
+			err:      &net.DNSError{IsTimeout: true},
+			failures: 3,
+			req:      new(methods.RetrievePropertiesBody),
+			calls:    3,
+			fails:    true,
+		},
+		"bad gateway retried": {
+			err:      &url.Error{Op: "Post", URL: "/sdk", Err: errors.New("502 Bad Gateway")},
+			failures: 1,
+			req:      new(methods.RetrievePropertiesBody),
+			calls:    2,
+		},
+		"service unavailable retried": {
+			err:      &url.Error{Op: "Post", URL: "/sdk", Err: errors.New("503 Service Unavailable")},
+			failures: 1,
+			req:      new(methods.RetrievePropertiesBody),
+			calls:    2,
+		},
+		"non idempotent method": {
+			err:      &net.DNSError{IsTimeout: true},
+			failures: 1,
+			req:      new(methods.CreateFolderBody),
+			calls:    1,
+			fails:    true,
+		},
+		"non transient error": {
+			err:      invalid,
+			failures: 1,
+			req:      new(methods.RetrievePropertiesBody),
+			calls:    1,
+			fails:    true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			inner := &failingRoundTripper{err: tc.err, failures: tc.failures}
+			rt := settings.withRetries(inner)
+
+			err := rt.RoundTrip(ctx, tc.req, new(methods.RetrievePropertiesBody))
+			if tc.fails != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			equal(t, tc.calls, inner.calls)
+		})
+	}
+}
+
+func TestRetryConnectionRefused(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	settings := getTestBackendSettings()
+	settings.MaxRetries = 2
+	settings.RetryBackoff = 10 * time.Millisecond
+	settings.RequestTimeout = time.Second
+
+	client, err := settings.makeGovmomiClient(context.Background(), settings.Username, settings.Password)
+	nilErr(t, err)
+
+	// the server goes away: the idempotent calls are retried before failing
+	govmomitest.TearDown()
+	start := time.Now()
+	_, err = methods.GetCurrentTime(context.Background(), client)
+	if err == nil {
+		t.Fatal("expected the call to fail")
+	}
+	if !isTransientError(err) {
+		t.Fatalf("expected a transient error, got %v", err)
+	}
+	if time.Since(start) < 30*time.Millisecond {
+		t.Fatal("expected the call to be retried with a backoff")
+	}
+}
+
+func TestRetryServiceClient(t *testing.T) {
+	ctx := context.Background()
+	settings := &clientSettings{
+		MaxRetries:   2,
+		RetryBackoff: time.Millisecond,
+	}
+	discovery := vimtypes.ManagedObjectReference{Type: "SsoAdminPrincipalDiscoveryService", Value: "principalDiscoveryService"}
+	management := vimtypes.ManagedObjectReference{Type: "SsoAdminPrincipalManagementService", Value: "principalManagementService"}
+
+	tests := map[string]struct {
+		status int
+		call   func(sc *soap.Client) error
+		calls  int
+	}{
+		"unavailable": {
+			status: http.StatusServiceUnavailable,
+			call: func(sc *soap.Client) error {
+				_, err := ssomethods.FindUser(ctx, sc, &ssotypes.FindUser{
+					This:   discovery,
+					UserId: ssotypes.PrincipalId{Name: "vault-user", Domain: "vsphere.local"},
+				})
+				return err
+			},
+			calls: 2,
+		},
+		"unavailable write": {
+			// the request was not processed, so it is sent again
+			status: http.StatusServiceUnavailable,
+			call: func(sc *soap.Client) error {
+				_, err := ssomethods.DeleteLocalPrincipal(ctx, sc, &ssotypes.DeleteLocalPrincipal{
+					This:          management,
+					PrincipalName: "vault-user",
+				})
+				return err
+			},
+			calls: 2,
+		},
+		"internal error": {
+			status: http.StatusInternalServerError,
+			call: func(sc *soap.Client) error {
+				_, err := ssomethods.FindUser(ctx, sc, &ssotypes.FindUser{This: discovery})
+				return err
+			},
+			calls: 1,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					w.WriteHeader(tc.status)
+					return
+				}
+				method := soapMethodRegex.FindStringSubmatch(readBody(t, r))
+				w.Header().Set("Content-Type", "text/xml")
+				fmt.Fprintf(w, `<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/">`+
+					`<soapenv:Body><%sResponse xmlns="urn:sso"></%sResponse></soapenv:Body></soapenv:Envelope>`, method[1], method[1])
+			}))
+			defer server.Close()
+
+			u, err := url.Parse(server.URL + "/sdk")
+			nilErr(t, err)
+			c := &vim25.Client{Client: soap.NewClient(u, true)}
+			sc := settings.newServiceClient(c, server.URL+"/sso-adminserver/sdk/vsphere.local", "sso")
+
+			err = tc.call(sc)
+			if tc.calls > 1 {
+				nilErr(t, err)
+			} else if err == nil {
+				t.Fatal("expected the call to fail")
+			}
+			equal(t, tc.calls, calls)
+		})
+	}
+}
+
+func readBody(t *testing.T, r *http.Request) string {
+	b, err := ioutil.ReadAll(r.Body)
+	nilErr(t, err)
+	return string(b)
+}
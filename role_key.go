@@ -0,0 +1,284 @@
+package vspheresecrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	roleKeyStoragePath = "role-key"
+
+	// roleKeyRotationPeriod is the age of the role key after which the periodic function rotates it.
+	roleKeyRotationPeriod = 30 * 24 * time.Hour
+)
+
+// roleKeyring holds the AES-256 keys that encrypt the role passwords, by version.
+// The passwords are encrypted with the key of the current version. The older versions are only
+// dropped once a rotation re-encrypted all the passwords.
+type roleKeyring struct {
+	Keys      map[int][]byte `json:"keys"`
+	Version   int            `json:"version"`
+	RotatedAt time.Time      `json:"rotated_at"`
+}
+
+func pathRoleKey(b *vsphereSecretBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/role-key/rotate",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathRoleKeyRotate,
+		},
+		HelpSynopsis:    roleKeyRotateHelpSyn,
+		HelpDescription: roleKeyRotateHelpDesc,
+	}
+}
+
+func (b *vsphereSecretBackend) pathRoleKeyRotate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.roleKeyRotationLock.Lock()
+	defer b.roleKeyRotationLock.Unlock()
+
+	keyring, err := b.rotateRoleKey(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"version": keyring.Version,
+		},
+	}, nil
+}
+
+// rotateRoleKeyIfNeeded rotates the role key when it is older than the rotation period.
+// The first rotation encrypts the passwords of the roles written before the passwords were encrypted.
+func (b *vsphereSecretBackend) rotateRoleKeyIfNeeded(ctx context.Context, s logical.Storage) error {
+	b.roleKeyRotationLock.Lock()
+	defer b.roleKeyRotationLock.Unlock()
+
+	keyring, err := getRoleKeyring(ctx, s)
+	if err != nil {
+		return err
+	}
+	if keyring != nil && time.Since(keyring.RotatedAt) < roleKeyRotationPeriod {
+		return nil
+	}
+	_, err = b.rotateRoleKey(ctx, s)
+	return err
+}
+
+// rotateRoleKey adds a new version of the role key and re-encrypts the role passwords with it.
+// The previous versions are dropped once all the passwords are re-encrypted.
+// It must be called with the roleKeyRotationLock held.
+func (b *vsphereSecretBackend) rotateRoleKey(ctx context.Context, s logical.Storage) (*roleKeyring, error) {
+	if err := b.addRoleKeyVersion(ctx, s); err != nil {
+		return nil, err
+	}
+
+	roles, err := s.List(ctx, rolesStoragePath+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing roles: {{err}}", err)
+	}
+	for _, name := range roles {
+		if err := b.reencryptRole(ctx, s, name); err != nil {
+			return nil, err
+		}
+	}
+
+	b.roleKeyLock.Lock()
+	defer b.roleKeyLock.Unlock()
+
+	keyring, err := getRoleKeyring(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	for version := range keyring.Keys {
+		if version != keyring.Version {
+			delete(keyring.Keys, version)
+		}
+	}
+	if err := saveRoleKeyring(ctx, s, keyring); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+// addRoleKeyVersion adds a new version of the role key, used by the passwords encrypted from then on.
+func (b *vsphereSecretBackend) addRoleKeyVersion(ctx context.Context, s logical.Storage) error {
+	b.roleKeyLock.Lock()
+	defer b.roleKeyLock.Unlock()
+
+	keyring, err := getRoleKeyring(ctx, s)
+	if err != nil {
+		return err
+	}
+	if keyring == nil {
+		keyring = &roleKeyring{Keys: make(map[int][]byte)}
+	}
+
+	key, err := generateRoleKey()
+	if err != nil {
+		return err
+	}
+	keyring.Version++
+	keyring.Keys[keyring.Version] = key
+	keyring.RotatedAt = time.Now()
+	return saveRoleKeyring(ctx, s, keyring)
+}
+
+// reencryptRole stores the password of a role again with the current version of the role key.
+// The role is read under its lock, so that a role deleted or updated meanwhile is not written back.
+func (b *vsphereSecretBackend) reencryptRole(ctx context.Context, s logical.Storage, name string) error {
+	lock := locksutil.LockForKey(b.roleLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	role, err := getRole(ctx, name, s)
+	if err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("error reading role '%s': {{err}}", name), err)
+	}
+	if role == nil || role.Password == "" {
+		return nil
+	}
+	if err := b.saveRole(ctx, s, role, name); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("error storing role '%s': {{err}}", name), err)
+	}
+	return nil
+}
+
+// roleKeyring returns the keyring of the mount, generated on first use.
+// It must be called with the roleKeyLock held.
+func (b *vsphereSecretBackend) roleKeyring(ctx context.Context, s logical.Storage) (*roleKeyring, error) {
+	keyring, err := getRoleKeyring(ctx, s)
+	if err != nil || keyring != nil {
+		return keyring, err
+	}
+	key, err := generateRoleKey()
+	if err != nil {
+		return nil, err
+	}
+	keyring = &roleKeyring{
+		Keys:      map[int][]byte{1: key},
+		Version:   1,
+		RotatedAt: time.Now(),
+	}
+	if err := saveRoleKeyring(ctx, s, keyring); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+func getRoleKeyring(ctx context.Context, s logical.Storage) (*roleKeyring, error) {
+	entry, err := s.Get(ctx, roleKeyStoragePath)
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading the role key: {{err}}", err)
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	keyring := new(roleKeyring)
+	if err := entry.DecodeJSON(keyring); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+func saveRoleKeyring(ctx context.Context, s logical.Storage, keyring *roleKeyring) error {
+	entry, err := logical.StorageEntryJSON(roleKeyStoragePath, keyring)
+	if err != nil {
+		return err
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		return errwrap.Wrapf("error storing the role key: {{err}}", err)
+	}
+	return nil
+}
+
+func generateRoleKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errwrap.Wrapf("error generating the role key: {{err}}", err)
+	}
+	return key, nil
+}
+
+// encrypt seals a value with the current key. The name of the role is authenticated with
+// the value, so that a password can not be moved to another role in storage.
+// The result is formatted as v<version>:<base64 of the nonce and the ciphertext>.
+func (k *roleKeyring) encrypt(name, plaintext string) (string, error) {
+	aead, err := newRoleKeyAEAD(k.Keys[k.Version])
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(name))
+	return fmt.Sprintf("v%d:%s", k.Version, base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// decrypt opens a value sealed by encrypt with any of the versions of the keyring.
+func (k *roleKeyring) decrypt(name, ciphertext string) (string, error) {
+	parts := strings.SplitN(ciphertext, ":", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "v") {
+		return "", errors.New("invalid encrypted value")
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(parts[0], "v"))
+	if err != nil {
+		return "", errors.New("invalid encrypted value")
+	}
+	key, ok := k.Keys[version]
+	if !ok {
+		return "", fmt.Errorf("version %d of the role key no longer exists", version)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.New("invalid encrypted value")
+	}
+
+	aead, err := newRoleKeyAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("invalid encrypted value")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return "", errwrap.Wrapf("error decrypting: {{err}}", err)
+	}
+	return string(plaintext), nil
+}
+
+func newRoleKeyAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+const roleKeyRotateHelpSyn = `Rotate the key that encrypts the role passwords.`
+const roleKeyRotateHelpDesc = `
+The passwords of the roles are encrypted in storage with a key of the mount. This endpoint
+generates a new version of the key, re-encrypts the passwords with it and deletes the
+previous versions.
+
+The key is also rotated every 30 days.
+
+The key is stored in the storage of the mount along with the encrypted passwords, seal-wrapped
+when the Vault server supports seal wrapping: only then does a copy of the storage not disclose
+the passwords.
+`
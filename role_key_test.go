@@ -0,0 +1,145 @@
+package vspheresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/helper/locksutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRolePasswordEncrypted(t *testing.T) {
+	b, s := getTestBackend(t, false)
+	ctx := context.Background()
+
+	testRoleCreate(t, b, s, "static", map[string]interface{}{
+		"username": "administrator@vsphere.local",
+		"password": "s3cr3t-passw0rd",
+	})
+
+	// the password is neither returned nor stored in plain text
+	resp := testRequest(t, b, s, logical.ReadOperation, "roles/static", nil)
+	if _, ok := resp.Data["password"]; ok {
+		t.Fatal("expected the password to be redacted")
+	}
+	equal(t, true, resp.Data["password_set"])
+
+	entry, err := s.Get(ctx, rolesStoragePath+"/static")
+	nilErr(t, err)
+	if strings.Contains(string(entry.Value), "s3cr3t-passw0rd") {
+		t.Fatal("expected the password to be encrypted in storage")
+	}
+
+	role, err := getRole(ctx, "static", s)
+	nilErr(t, err)
+	equal(t, "s3cr3t-passw0rd", role.Password)
+
+	// the password can not be moved to another role
+	nilErr(t, s.Put(ctx, &logical.StorageEntry{Key: rolesStoragePath + "/moved", Value: entry.Value}))
+	if _, err := getRole(ctx, "moved", s); err == nil {
+		t.Fatal("expected the password of another role to be rejected")
+	}
+	nilErr(t, s.Delete(ctx, rolesStoragePath+"/moved"))
+
+	t.Run("Rotate", func(t *testing.T) {
+		resp := testRequest(t, b, s, logical.UpdateOperation, "config/role-key/rotate", nil)
+		equal(t, 2, resp.Data["version"])
+
+		keyring, err := getRoleKeyring(ctx, s)
+		nilErr(t, err)
+		equal(t, 1, len(keyring.Keys))
+
+		role, err := getRole(ctx, "static", s)
+		nilErr(t, err)
+		equal(t, "s3cr3t-passw0rd", role.Password)
+
+		stored, err := s.Get(ctx, rolesStoragePath+"/static")
+		nilErr(t, err)
+		if !strings.Contains(string(stored.Value), `"encrypted_password":"v2:`) {
+			t.Fatalf("expected the password to be encrypted with the new key, got %s", stored.Value)
+		}
+	})
+
+	t.Run("Periodic", func(t *testing.T) {
+		// the key is only rotated once it is older than the rotation period
+		nilErr(t, b.rotateRoleKeyIfNeeded(ctx, s))
+		keyring, err := getRoleKeyring(ctx, s)
+		nilErr(t, err)
+		equal(t, 2, keyring.Version)
+
+		keyring.RotatedAt = time.Now().Add(-roleKeyRotationPeriod)
+		nilErr(t, saveRoleKeyring(ctx, s, keyring))
+		nilErr(t, b.rotateRoleKeyIfNeeded(ctx, s))
+		keyring, err = getRoleKeyring(ctx, s)
+		nilErr(t, err)
+		equal(t, 3, keyring.Version)
+	})
+
+	t.Run("PlainText", func(t *testing.T) {
+		// the passwords stored in plain text by the older versions are encrypted by the rotation
+		legacy, err := logical.StorageEntryJSON(rolesStoragePath+"/legacy", map[string]interface{}{
+			"username": "administrator@vsphere.local",
+			"password": "legacy-passw0rd",
+		})
+		nilErr(t, err)
+		nilErr(t, s.Put(ctx, legacy))
+
+		role, err := getRole(ctx, "legacy", s)
+		nilErr(t, err)
+		equal(t, "legacy-passw0rd", role.Password)
+
+		testRequest(t, b, s, logical.UpdateOperation, "config/role-key/rotate", nil)
+		stored, err := s.Get(ctx, rolesStoragePath+"/legacy")
+		nilErr(t, err)
+		if strings.Contains(string(stored.Value), "legacy-passw0rd") {
+			t.Fatal("expected the password to be encrypted")
+		}
+		role, err = getRole(ctx, "legacy", s)
+		nilErr(t, err)
+		equal(t, "legacy-passw0rd", role.Password)
+	})
+
+	t.Run("Deleted", func(t *testing.T) {
+		// a role deleted while the key is rotated is not written back
+		lock := locksutil.LockForKey(b.roleLocks, "static")
+		lock.Lock()
+		done := make(chan error)
+		go func() {
+			_, err := b.rotateRoleKey(ctx, s)
+			done <- err
+		}()
+		nilErr(t, s.Delete(ctx, rolesStoragePath+"/static"))
+		lock.Unlock()
+		nilErr(t, <-done)
+
+		role, err := getRole(ctx, "static", s)
+		nilErr(t, err)
+		if role != nil {
+			t.Fatal("expected the deleted role not to be stored again")
+		}
+	})
+}
+
+func TestRoleKeySealWrapped(t *testing.T) {
+	b, _ := getTestBackend(t, false)
+
+	// the role key is stored along with the passwords it encrypts: only the seal protects them
+	for _, key := range []string{roleKeyStoragePath, rolesStoragePath + "/static", sessionStorageKey("static", "id")} {
+		if !sealWrapped(b.PathsSpecial.SealWrapStorage, key) {
+			t.Fatalf("expected '%s' to be seal-wrapped", key)
+		}
+	}
+}
+
+// sealWrapped returns whether a storage key matches the seal-wrapped paths, as matched by Vault:
+// the paths ending with '*' are prefixes.
+func sealWrapped(paths []string, key string) bool {
+	for _, p := range paths {
+		if strings.HasSuffix(p, "*") && strings.HasPrefix(key, strings.TrimSuffix(p, "*")) || p == key {
+			return true
+		}
+	}
+	return false
+}
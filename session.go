@@ -0,0 +1,108 @@
+package vspheresecrets
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+type reloginContext struct{}
+
+// reloginRoundTripper logs in again and retries a call once when the session
+// of the mount has expired or was terminated on the server.
+type reloginRoundTripper struct {
+	roundTripper soap.RoundTripper
+	login        func(ctx context.Context) error
+
+	lock   sync.Mutex
+	closed bool
+}
+
+func newReloginRoundTripper(roundTripper soap.RoundTripper, login func(ctx context.Context) error) *reloginRoundTripper {
+	return &reloginRoundTripper{
+		roundTripper: roundTripper,
+		login:        login,
+	}
+}
+
+func (rt *reloginRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	err := rt.roundTripper.RoundTrip(ctx, req, res)
+	if ctx.Value(reloginContext{}) != nil {
+		return err
+	}
+	if !isNotAuthenticated(err) && !(err == nil && isMissingAuthentication(res)) {
+		return err
+	}
+
+	if rt.relogin(ctx) != nil {
+		return err
+	}
+
+	resetResponse(res)
+	return rt.roundTripper.RoundTrip(ctx, req, res)
+}
+
+func (rt *reloginRoundTripper) relogin(ctx context.Context) error {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	if rt.closed {
+		return errors.New("the session is closed")
+	}
+	// the calls made to login must not trigger another login
+	return rt.login(context.WithValue(ctx, reloginContext{}, true))
+}
+
+// close stops the round tripper from logging in again, once the session is logged out on purpose.
+func (rt *reloginRoundTripper) close() {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	rt.closed = true
+}
+
+// isNotAuthenticated returns whether the error is a NotAuthenticated fault.
+func isNotAuthenticated(err error) bool {
+	if err == nil || !soap.IsSoapFault(err) {
+		return false
+	}
+	_, ok := soap.ToSoapFault(err).VimFault().(types.NotAuthenticated)
+	return ok
+}
+
+// isMissingAuthentication returns whether the properties of a response are missing because
+// the session is not authenticated. The property collector does not fault in that case.
+func isMissingAuthentication(res soap.HasFault) bool {
+	var objects []types.ObjectContent
+	switch res := res.(type) {
+	case *methods.RetrievePropertiesBody:
+		if res.Res != nil {
+			objects = res.Res.Returnval
+		}
+	case *methods.RetrievePropertiesExBody:
+		if res.Res != nil && res.Res.Returnval != nil {
+			objects = res.Res.Returnval.Objects
+		}
+	}
+
+	for _, o := range objects {
+		for _, p := range o.MissingSet {
+			if _, ok := p.Fault.Fault.(*types.NotAuthenticated); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resetResponse clears a decoded response body so that it can be reused for a retry.
+func resetResponse(res soap.HasFault) {
+	v := reflect.ValueOf(res)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v.Elem().Set(reflect.Zero(v.Elem().Type()))
+	}
+}
@@ -0,0 +1,115 @@
+package vspheresecrets
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestMountSessionRelogin(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	ctx := context.Background()
+
+	client, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	mount := client.provider.GetMountGovmomiClient()
+	admin := testAdminClient(t)
+
+	// the session is terminated on the server: the mount logs in again transparently
+	key := testSessionKey(t, mount)
+	nilErr(t, admin.SessionManager.TerminateSession(ctx, []string{key}))
+	testListDatacenters(t, mount)
+
+	if testSessionKey(t, mount) == key {
+		t.Fatal("expected a new session")
+	}
+}
+
+func TestMountSessionLogout(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	ctx := context.Background()
+	admin := testAdminClient(t)
+
+	t.Run("Reset", func(t *testing.T) {
+		client, err := b.getClient(ctx, s)
+		nilErr(t, err)
+		key := testSessionKey(t, client.provider.GetMountGovmomiClient())
+
+		b.reset()
+		b.connection(defaultConnectionName).settings = getTestBackendSettings()
+
+		if testSessionIsActive(t, admin, key) {
+			t.Fatal("expected the session to be logged out on reset")
+		}
+	})
+
+	t.Run("Clean", func(t *testing.T) {
+		client, err := b.getClient(ctx, s)
+		nilErr(t, err)
+		key := testSessionKey(t, client.provider.GetMountGovmomiClient())
+
+		b.Clean(ctx)
+
+		if testSessionIsActive(t, admin, key) {
+			t.Fatal("expected the session to be logged out on clean")
+		}
+	})
+
+	t.Run("HealthCheck", func(t *testing.T) {
+		b.connection(defaultConnectionName).settings = getTestBackendSettings()
+		client, err := b.getClient(ctx, s)
+		nilErr(t, err)
+
+		// a session that is logged out is replaced after the check interval
+		nilErr(t, client.provider.Close(ctx))
+		client.checked = client.checked.Add(-sessionCheckInterval)
+
+		replaced, err := b.getClient(ctx, s)
+		nilErr(t, err)
+		if replaced == client {
+			t.Fatal("expected the client to be replaced")
+		}
+		testListDatacenters(t, replaced.provider.GetMountGovmomiClient())
+	})
+}
+
+// testAdminClient returns a client logged in independently of the backend.
+func testAdminClient(t *testing.T) *govmomi.Client {
+	t.Helper()
+	settings := getTestBackendSettings()
+	c, err := settings.makeGovmomiClient(context.Background(), settings.Username, settings.Password)
+	nilErr(t, err)
+	return c
+}
+
+func testSessionKey(t *testing.T, c *govmomi.Client) string {
+	t.Helper()
+	session, err := c.SessionManager.UserSession(context.Background())
+	nilErr(t, err)
+	if session == nil {
+		t.Fatal("expected the client to be logged in")
+	}
+	return session.Key
+}
+
+func testSessionIsActive(t *testing.T, admin *govmomi.Client, key string) bool {
+	t.Helper()
+	req := types.SessionIsActive{
+		This:      *admin.ServiceContent.SessionManager,
+		SessionID: key,
+		UserName:  govmomitest.SimulatorServerSudoerUsername,
+	}
+	res, err := methods.SessionIsActive(context.Background(), admin, &req)
+	nilErr(t, err)
+	return res.Returnval
+}
@@ -0,0 +1,218 @@
+package vspheresecrets
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/vmware/govmomi/lookup"
+	lmethods "github.com/vmware/govmomi/lookup/methods"
+	ltypes "github.com/vmware/govmomi/lookup/types"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/ssoadmin"
+	ssomethods "github.com/vmware/govmomi/ssoadmin/methods"
+	ssotypes "github.com/vmware/govmomi/ssoadmin/types"
+	"github.com/vmware/govmomi/sts"
+	"github.com/vmware/govmomi/vapi/rest"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/soap"
+	vimtypes "github.com/vmware/govmomi/vim25/types"
+)
+
+// ssoEndpoints are the URLs of the SSO services of a connection.
+// The Platform Services Controller that hosts them may be external to the vCenter.
+type ssoEndpoints struct {
+	// LookupURL is empty when no lookup service could be reached, such as with an ESX host.
+	LookupURL   string
+	STSURL      string
+	SSOAdminURL string
+}
+
+var (
+	stsEndpointFilter = &ltypes.LookupServiceRegistrationFilter{
+		ServiceType: &ltypes.LookupServiceRegistrationServiceType{
+			Product: "com.vmware.cis",
+			Type:    "cs.identity",
+		},
+		EndpointType: &ltypes.LookupServiceRegistrationEndpointType{
+			Protocol: "wsTrust",
+			Type:     "com.vmware.cis.cs.identity.sso",
+		},
+	}
+
+	ssoAdminEndpointFilter = &ltypes.LookupServiceRegistrationFilter{
+		ServiceType: &ltypes.LookupServiceRegistrationServiceType{
+			Product: "com.vmware.cis",
+			Type:    "cs.identity",
+		},
+		EndpointType: &ltypes.LookupServiceRegistrationEndpointType{
+			Protocol: "vmomi",
+			Type:     "com.vmware.cis.cs.identity.admin",
+		},
+	}
+)
+
+// discoverLookupURL derives the URL of the lookup service from the STS URL registered in the
+// vCenter settings, as the Platform Services Controller may be external. It defaults to the vCenter host.
+// It mirrors lookup.NewClient.
+func discoverLookupURL(ctx context.Context, c *vim25.Client) string {
+	u := &url.URL{Path: lookup.Path}
+	m := object.NewOptionManager(c, *c.ServiceContent.Setting)
+	opts, err := m.Query(ctx, "config.vpxd.sso.sts.uri")
+	if err == nil && len(opts) == 1 {
+		if stsURL, err := url.Parse(opts[0].GetOptionValue().Value.(string)); err == nil {
+			u.Scheme = stsURL.Scheme
+			u.Host = stsURL.Host
+		}
+	}
+	return u.String()
+}
+
+// newLookupClient returns a client of the lookup service at the configured lookup URL.
+// When no lookup URL is configured, it is derived from the STS URL registered in the vCenter settings.
+func (settings *clientSettings) newLookupClient(ctx context.Context, c *vim25.Client) (*lookup.Client, error) {
+	lookupURL := settings.LookupURL
+	if lookupURL == "" {
+		lookupURL = discoverLookupURL(ctx, c)
+	}
+
+	sc := settings.newServiceClient(c, lookupURL, lookup.Namespace)
+	sc.Version = lookup.Version
+
+	req := ltypes.RetrieveServiceContent{
+		This: lookup.ServiceInstance,
+	}
+	res, err := lmethods.RetrieveServiceContent(ctx, sc, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lookup.Client{Client: sc, ServiceContent: res.Returnval}, nil
+}
+
+// resolveSSOEndpoints returns the configured STS and lookup service URLs.
+// The URLs that are not configured are discovered through the lookup service, and default
+// to the well known paths on the vCenter host when the lookup service is not available.
+func (settings *clientSettings) resolveSSOEndpoints(ctx context.Context, c *vim25.Client) (*ssoEndpoints, error) {
+	endpoints := &ssoEndpoints{
+		STSURL: settings.STSURL,
+	}
+
+	lc, err := settings.newLookupClient(ctx, c)
+	if err != nil && settings.LookupURL != "" {
+		return nil, errwrap.Wrapf("error connecting to the lookup service: {{err}}", err)
+	}
+	if err == nil {
+		endpoints.LookupURL = lc.URL().String()
+		if endpoints.STSURL == "" {
+			endpoints.STSURL = lookupEndpointURL(ctx, lc, stsEndpointFilter)
+		}
+		endpoints.SSOAdminURL = lookupEndpointURL(ctx, lc, ssoAdminEndpointFilter)
+	}
+
+	if endpoints.STSURL == "" {
+		endpoints.STSURL = c.URL().ResolveReference(&url.URL{Path: sts.Path}).String()
+	}
+	if endpoints.SSOAdminURL == "" {
+		u, err := url.Parse(endpoints.STSURL)
+		if err != nil {
+			return nil, err
+		}
+		endpoints.SSOAdminURL = u.ResolveReference(&url.URL{Path: ssoadmin.Path}).String()
+	}
+
+	return endpoints, nil
+}
+
+// lookupEndpointURL returns the URL of the first endpoint registered for the filter,
+// or an empty string when there is none.
+func lookupEndpointURL(ctx context.Context, lc *lookup.Client, filter *ltypes.LookupServiceRegistrationFilter) string {
+	infos, err := lc.List(ctx, filter)
+	if err != nil {
+		return ""
+	}
+	for _, info := range infos {
+		for _, e := range info.ServiceEndpoints {
+			if e.Url != "" {
+				return e.Url
+			}
+		}
+	}
+	return ""
+}
+
+// newServiceClient returns a soap client of a service sharing the TLS configuration of the vim25 client.
+// The transport of a service client is new, so the timeout, proxy and retries are applied again.
+func (settings *clientSettings) newServiceClient(c *vim25.Client, rawURL, namespace string) *soap.Client {
+	sc := c.Client.NewServiceClient(rawURL, namespace)
+	sc.Timeout = settings.RequestTimeout
+	settings.applyProxy(sc.Transport)
+	sc.Transport = settings.withHTTPRetries(sc.Transport)
+	return sc
+}
+
+// newRestClient returns a client of the vAPI REST endpoint of the vCenter, such as the tagging service.
+func (settings *clientSettings) newRestClient(c *vim25.Client) *rest.Client {
+	rc := rest.NewClient(c)
+	rc.Timeout = settings.RequestTimeout
+	settings.applyProxy(rc.Transport)
+	rc.Transport = settings.withHTTPRetries(rc.Transport)
+	return rc
+}
+
+// newSTSClient returns a client of the STS at the resolved endpoint.
+func (settings *clientSettings) newSTSClient(c *vim25.Client, endpoints *ssoEndpoints) *sts.Client {
+	return &sts.Client{
+		Client: settings.newServiceClient(c, endpoints.STSURL, sts.Namespace),
+	}
+}
+
+// ssoDomain returns the name of the SSO domain of the SSO admin service.
+// The registered endpoint ends with the name of the SSO domain, otherwise it is the default domain.
+func ssoDomain(ssoAdminURL *url.URL) string {
+	if !strings.HasSuffix(ssoAdminURL.Path, ssoadmin.Path) {
+		return path.Base(ssoAdminURL.Path)
+	}
+	return "vsphere.local"
+}
+
+// newSSOAdminClient returns a client of the SSO admin service at the resolved endpoint.
+// It mirrors ssoadmin.NewClient, which only supports the endpoint registered in the lookup service.
+func (settings *clientSettings) newSSOAdminClient(ctx context.Context, c *vim25.Client, endpoints *ssoEndpoints) (*ssoadmin.Client, error) {
+	sc := settings.newServiceClient(c, endpoints.SSOAdminURL, ssoadmin.Namespace)
+	sc.Version = ssoadmin.Version
+
+	admin := &ssoadmin.Client{
+		Client: sc,
+		Domain: ssoDomain(sc.URL()),
+		Limit:  100,
+	}
+
+	{
+		req := ssotypes.SsoAdminServiceInstance{
+			This: ssoadmin.ServiceInstance,
+		}
+		res, err := ssomethods.SsoAdminServiceInstance(ctx, sc, &req)
+		if err != nil {
+			return nil, err
+		}
+		admin.ServiceContent = res.Returnval
+	}
+
+	{
+		req := ssotypes.SsoGroupcheckServiceInstance{
+			This: vimtypes.ManagedObjectReference{
+				Type: "SsoGroupcheckServiceInstance", Value: "ServiceInstance",
+			},
+		}
+		res, err := ssomethods.SsoGroupcheckServiceInstance(ctx, sc, &req)
+		if err != nil {
+			return nil, err
+		}
+		admin.GroupCheck = res.Returnval
+	}
+
+	return admin, nil
+}
@@ -0,0 +1,129 @@
+package vspheresecrets
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+)
+
+const (
+	// defaultUsernameCharset is the charset of the random characters of the usernames.
+	defaultUsernameCharset = "abcdefghijklmnopqrstuvwxyz0123456789"
+	// usernameAllowedChars are the characters accepted in the names of both the SSO users and the ESXi accounts.
+	usernameAllowedChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_."
+	// maxUsernameLength is the shortest of the maximum lengths of the SSO users and of the ESXi accounts.
+	maxUsernameLength = 31
+	// minUsernameRandomChars is the minimum number of random characters of a username template.
+	minUsernameRandomChars = 3
+	// maxUsernameAttempts bounds the number of usernames generated until one is not taken.
+	maxUsernameAttempts = 5
+)
+
+// defaultUsernameTemplate returns the username template of a role without one, shortened to fit the maximum length.
+func defaultUsernameTemplate(name string) string {
+	if len(name) > maxUsernameLength-len("-???") {
+		name = name[:maxUsernameLength-len("-???")]
+	}
+	return strings.TrimRight(name, "-_.") + "-???"
+}
+
+// validateUsernameTemplate returns an error when the usernames generated from a template would not be valid.
+// The identity templates are not counted, since their values are only known when the credentials are requested.
+// The number of random characters is checked separately by validateUsernameRandomChars.
+func validateUsernameTemplate(template string) error {
+	literal := identityTemplateRegex.ReplaceAllString(template, "")
+	if literal == "" {
+		return errors.New("the username must not be empty")
+	}
+	if len(literal) > maxUsernameLength {
+		return fmt.Errorf("the username must not be longer than %d characters", maxUsernameLength)
+	}
+	if i := strings.IndexFunc(literal, func(r rune) bool {
+		return r != '?' && !strings.ContainsRune(usernameAllowedChars, r)
+	}); i != -1 {
+		return fmt.Errorf("the username must only contain letters, digits, '-', '_', '.' and '?': found '%c'", literal[i])
+	}
+	if !hasIdentityTemplate(template) || identityTemplateRegex.FindStringIndex(template)[0] != 0 {
+		if strings.ContainsRune("-_.", rune(literal[0])) {
+			return errors.New("the username must start with a letter, a digit or '?'")
+		}
+	}
+	return nil
+}
+
+// validateUsernameRandomChars returns an error when a username template has too few random characters to
+// generate usernames that are not taken. It only applies to the usernames written since the minimum was
+// introduced: the roles stored before keep their username, a fixed one included.
+func validateUsernameRandomChars(template string) error {
+	literal := identityTemplateRegex.ReplaceAllString(template, "")
+	if strings.Count(literal, "?") < minUsernameRandomChars {
+		return fmt.Errorf("the username must contain at least %d '?' characters", minUsernameRandomChars)
+	}
+	return nil
+}
+
+// validateUsernameCharset returns an error when the random characters of the usernames could be invalid or too few.
+func validateUsernameCharset(charset string) error {
+	distinct := make(map[rune]bool)
+	for _, r := range charset {
+		if !strings.ContainsRune(usernameAllowedChars, r) {
+			return fmt.Errorf("the username_charset must only contain letters, digits, '-', '_' and '.': found '%c'", r)
+		}
+		distinct[r] = true
+	}
+	if len(distinct) < 2 {
+		return errors.New("the username_charset must contain at least 2 distinct characters")
+	}
+	return nil
+}
+
+// generateUsername replaces each '?' character of the template with a random character of the charset.
+func generateUsername(template, charset string) (string, error) {
+	if charset == "" {
+		charset = defaultUsernameCharset
+	}
+	username := []byte(template)
+	for i := range username {
+		if username[i] != '?' {
+			continue
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		if err != nil {
+			return "", err
+		}
+		username[i] = charset[n.Int64()]
+	}
+	return string(username), nil
+}
+
+// generateUniqueUsername generates usernames from a template until one is not taken by an existing SSO user.
+// Reusing the name of an existing user would grant it the permissions of the lease, and delete it on revocation.
+// A fixed username, without random characters, is checked once.
+func (c *client) generateUniqueUsername(ctx context.Context, template, charset string) (string, error) {
+	attempts := maxUsernameAttempts
+	if !strings.ContainsRune(template, '?') {
+		attempts = 1
+	}
+	for attempt := 0; attempt < attempts; attempt++ {
+		username, err := generateUsername(template, charset)
+		if err != nil {
+			return "", err
+		}
+		exists, err := c.provider.UserExists(ctx, username)
+		if err != nil {
+			return "", errwrap.Wrapf(fmt.Sprintf("error looking up the user '%s': {{err}}", username), err)
+		}
+		if !exists {
+			return username, nil
+		}
+		if attempts == 1 {
+			return "", fmt.Errorf("the user '%s' already exists: the username of the role has no '?' to generate another one", username)
+		}
+	}
+	return "", fmt.Errorf("unable to generate a username that is not taken from '%s' in %d attempts", template, maxUsernameAttempts)
+}
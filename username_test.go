@@ -0,0 +1,172 @@
+package vspheresecrets
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+)
+
+func TestValidateUsernameTemplate(t *testing.T) {
+	for _, template := range []string{
+		"vault-???",
+		"???",
+		"Vault_test.????",
+		"vault-{{identity.entity.name}}-????",
+		"{{identity.entity.name}}-???",
+		defaultUsernameTemplate("a-role-name-longer-than-the-maximum-length-of-a-username"),
+	} {
+		nilErr(t, validateUsernameTemplate(template))
+	}
+
+	for _, template := range []string{
+		"",
+		"vault@vsphere.local-???",
+		"vault ???",
+		"-vault-???",
+		"vault-a-very-long-username-with-????",
+	} {
+		if err := validateUsernameTemplate(template); err == nil {
+			t.Fatalf("expected '%s' to be rejected", template)
+		}
+	}
+}
+
+func TestValidateUsernameRandomChars(t *testing.T) {
+	nilErr(t, validateUsernameRandomChars("vault-???"))
+	nilErr(t, validateUsernameRandomChars("{{identity.entity.name}}-???"))
+	for _, template := range []string{"vault", "vault-??", "{{identity.entity.name}}-?"} {
+		nilErr(t, validateUsernameTemplate(template))
+		if err := validateUsernameRandomChars(template); err == nil {
+			t.Fatalf("expected '%s' to be rejected", template)
+		}
+	}
+}
+
+func TestValidateUsernameCharset(t *testing.T) {
+	nilErr(t, validateUsernameCharset("abcdef"))
+	nilErr(t, validateUsernameCharset("AB01-_."))
+	for _, charset := range []string{"a", "aaa", "ab?", "ab@", "ab c"} {
+		if err := validateUsernameCharset(charset); err == nil {
+			t.Fatalf("expected '%s' to be rejected", charset)
+		}
+	}
+}
+
+func TestGenerateUsername(t *testing.T) {
+	username, err := generateUsername("vault-????????", "xy")
+	nilErr(t, err)
+	if !strings.HasPrefix(username, "vault-") || strings.Trim(username[len("vault-"):], "xy") != "" {
+		t.Fatalf("unexpected username %s", username)
+	}
+
+	username, err = generateUsername("vault-????", "")
+	nilErr(t, err)
+	if strings.Trim(username[len("vault-"):], defaultUsernameCharset) != "" {
+		t.Fatalf("unexpected username %s", username)
+	}
+}
+
+func TestSPReadUsernameCollision(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	m := useMockProvider(b)
+	ctx := context.Background()
+
+	testRoleCreate(t, b, s, "binary", map[string]interface{}{
+		"username":         "vault-???",
+		"username_charset": "01",
+		"vsphere_roles":    "ReadOnly",
+	})
+	resp := testRequest(t, b, s, logical.ReadOperation, "roles/binary", nil)
+	equal(t, "01", resp.Data["username_charset"])
+
+	resp = testRequest(t, b, s, logical.ReadOperation, "session/binary", nil)
+	username := resp.Data["username"].(string)
+	if strings.Trim(username[len("vault-"):], "01") != "" {
+		t.Fatalf("unexpected username %s", username)
+	}
+
+	// the existing users are never reused
+	for _, name := range []string{"vault-000", "vault-001", "vault-010", "vault-011", "vault-100", "vault-101", "vault-110", "vault-111"} {
+		if name != username {
+			nilErr(t, m.CreateUser(ctx, name, "", "", nil))
+		}
+	}
+	testSPReadError(t, b, s, "binary")
+	equal(t, 8, m.userCount())
+
+	for _, data := range []map[string]interface{}{
+		{"username": "vault", "vsphere_roles": "ReadOnly"},
+		{"username": "vault@vsphere.local-???", "vsphere_roles": "ReadOnly"},
+		{"username_charset": "a", "vsphere_roles": "ReadOnly"},
+	} {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "roles/invalid",
+			Data:      data,
+			Storage:   s,
+		})
+		nilErr(t, err)
+		if !resp.IsError() {
+			t.Fatalf("expected %v to be rejected", data)
+		}
+	}
+}
+
+func TestSPReadLegacyUsername(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	m := useMockProvider(b)
+	ctx := context.Background()
+
+	// a role stored before the minimum number of random characters, with a fixed username
+	entry, err := logical.StorageEntryJSON(rolesStoragePath+"/legacy", map[string]interface{}{
+		"schema_version": roleSchemaVersion,
+		"username":       "legacy-user",
+		"vsphere_roles":  []map[string]interface{}{{"role_name": "ReadOnly"}},
+	})
+	nilErr(t, err)
+	nilErr(t, s.Put(ctx, entry))
+
+	// the role can still be updated without changing its username
+	testRequest(t, b, s, logical.UpdateOperation, "roles/legacy", map[string]interface{}{"ttl": "1h"})
+
+	resp := testRequest(t, b, s, logical.ReadOperation, "session/legacy", nil)
+	equal(t, "legacy-user", resp.Data["username"])
+
+	// the fixed username is not generated again while it is taken
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "session/legacy",
+		Storage:   s,
+	})
+	if err == nil && !resp.IsError() {
+		t.Fatal("expected the credentials of a taken fixed username to be refused")
+	}
+	if err == nil {
+		err = resp.Error()
+	}
+	if !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	equal(t, 1, m.userCount())
+
+	// a new username must have enough random characters
+	resp, err = b.HandleRequest(ctx, &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/legacy",
+		Data:      map[string]interface{}{"username": "other-user"},
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if !resp.IsError() {
+		t.Fatal("expected a new fixed username to be rejected")
+	}
+}
@@ -0,0 +1,53 @@
+package vspheresecrets
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	walUserKind = "userCreate"
+
+	// walRollbackMinAge leaves the time to create a user and return its lease before it is rolled back.
+	walRollbackMinAge = 10 * time.Minute
+	// maxWALAge bounds the time the rollback of a user is retried.
+	maxWALAge = 24 * time.Hour
+)
+
+// walUser records a dynamic user before it is created.
+type walUser struct {
+	dynamicUser
+	Expiration time.Time `json:"expiration"`
+}
+
+// walRollback deletes a dynamic user whose lease was not returned, along with its permissions
+// and group memberships.
+func (b *vsphereSecretBackend) walRollback(ctx context.Context, req *logical.Request, kind string, data interface{}) error {
+	if kind != walUserKind {
+		return fmt.Errorf("unknown rollback type %q", kind)
+	}
+
+	var entry walUser
+	if err := decodeJSON(data, &entry); err != nil {
+		return err
+	}
+
+	c, err := b.getConnectionClient(ctx, req.Storage, entry.Connection)
+	if err == nil {
+		err = c.deleteUser(ctx, &entry.dynamicUser)
+	}
+	if err == nil {
+		err = deletePrincipal(ctx, req.Storage, &entry.dynamicUser)
+	}
+
+	// Give up once the WAL expired, as the user may never be deleted, for example
+	// when its connection was removed.
+	if err != nil && time.Now().After(entry.Expiration) {
+		b.Logger().Warn("giving up on the rollback of the user", "username", entry.Username, "error", err)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,103 @@
+package vspheresecrets
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hmalphettes/vault-plugin-secrets-vsphere/govmomitest"
+)
+
+func TestWALRollback(t *testing.T) {
+	_ = govmomitest.Setup(t)
+	defer govmomitest.TearDown()
+
+	b, s := getTestBackend(t, false)
+	m := useMockProvider(b)
+	ctx := context.Background()
+
+	client, err := b.getClient(ctx, s)
+	nilErr(t, err)
+	root := client.provider.GetMountGovmomiClient().ServiceContent.RootFolder
+
+	// Vault stopped after the user was created and granted its permission
+	user := dynamicUser{
+		Username:    "vault-crashed",
+		Groups:      []string{"PerfView"},
+		Permissions: []vspherePermission{{Entity: root.String(), Role: "ReadOnly"}},
+	}
+	_, err = framework.PutWAL(ctx, s, walUserKind, &walUser{dynamicUser: user, Expiration: time.Now().Add(maxWALAge)})
+	nilErr(t, err)
+	nilErr(t, client.createUser(ctx, &user, "Va1-password", "crashed"))
+
+	t.Run("MinAge", func(t *testing.T) {
+		testRollback(t, b, s, false)
+		testWALCount(t, s, 1)
+		if !m.userExists(user.Username) {
+			t.Fatal("expected the user to be kept until the WAL is old enough")
+		}
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		m.setDeleteUserErr(errors.New("SSO admin service unavailable"))
+		defer m.setDeleteUserErr(nil)
+
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.RollbackOperation,
+			Data:      map[string]interface{}{"immediate": true},
+			Storage:   s,
+		})
+		if err == nil && !resp.IsError() {
+			t.Fatal("expected the rollback to fail")
+		}
+		testWALCount(t, s, 1)
+	})
+
+	t.Run("Rollback", func(t *testing.T) {
+		testRollback(t, b, s, true)
+		testWALCount(t, s, 0)
+		if m.userExists(user.Username) || m.isGroupMember("PerfView", user.Username) {
+			t.Fatal("expected the user to be deleted")
+		}
+		equal(t, 0, len(testUserRootRoles(t, b, s, user.Username)))
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		m.setDeleteUserErr(errors.New("SSO admin service unavailable"))
+		defer m.setDeleteUserErr(nil)
+
+		_, err = framework.PutWAL(ctx, s, walUserKind, &walUser{dynamicUser: user, Expiration: time.Now().Add(-time.Minute)})
+		nilErr(t, err)
+
+		// the rollback is given up once the WAL expired
+		testRollback(t, b, s, true)
+		testWALCount(t, s, 0)
+	})
+}
+
+func testRollback(t *testing.T, b *vsphereSecretBackend, s logical.Storage, immediate bool) {
+	t.Helper()
+	data := map[string]interface{}{}
+	if immediate {
+		data["immediate"] = true
+	}
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RollbackOperation,
+		Data:      data,
+		Storage:   s,
+	})
+	nilErr(t, err)
+	if resp != nil && resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+}
+
+func testWALCount(t *testing.T, s logical.Storage, expected int) {
+	t.Helper()
+	keys, err := framework.ListWAL(context.Background(), s)
+	nilErr(t, err)
+	equal(t, expected, len(keys))
+}